@@ -0,0 +1,263 @@
+package main
+
+import (
+	"os"
+	"io"
+	"log"
+	"fmt"
+	"time"
+	"flag"
+	"reflect"
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	BackupFormat  = "postfix-go-backup"
+	BackupVersion = 1
+)
+
+type BackupTable struct {
+	Name          string
+	Model         interface{}
+	Rows          func() interface{}
+}
+
+type BackupArchive struct {
+	Format        string                     `json:"format"`
+	Version       int                        `json:"version"`
+	CreatedAt     time.Time                  `json:"created_at"`
+	DB_Type       string                     `json:"db_type"`
+	Schema        int                        `json:"schema"`
+	Tables        map[string]json.RawMessage `json:"tables"`
+}
+
+// BackupTables lists every table in restore order, i.e. referenced
+// tables first. New tables must be added here to be part of a backup.
+// The mail log statistics are left out, they can be imported again,
+// and so are the mail queue, the failed hooks and the webhook log.
+// The relay recipients are built from the domains after a restore.
+var BackupTables = []BackupTable{
+	{"domains",   &Domain{},  func() interface{} { return &[]Domain{} }},
+	{"addresses", &Address{}, func() interface{} { return &[]Address{} }},
+	{"aliases",   &Alias{},   func() interface{} { return &[]Alias{} }},
+	{"notices",   &Notice{},  func() interface{} { return &[]Notice{} }},
+}
+
+func BackupCommand(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.Parse(args)
+
+	out := io.Writer(os.Stdout)
+	if flags.NArg() > 0 {
+		file, err := os.Create(flags.Arg(0))
+		if err != nil {
+			log.Printf("ERROR Backup: %s", err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	db := OpenDB(nil, false)
+	defer CloseDB(db)
+
+	schema, err := MigrateCurrent(db)
+	if err != nil {
+		log.Printf("ERROR Backup: %s", err)
+		return 1
+	}
+
+	archive := BackupArchive{
+		Format:    BackupFormat,
+		Version:   BackupVersion,
+		CreatedAt: time.Now(),
+		DB_Type:   DB_Type,
+		Schema:    schema,
+		Tables:    make(map[string]json.RawMessage),
+	}
+
+	for _, table := range BackupTables {
+		rows := table.Rows()
+		if err := db.Order("id").Find(rows).Error; err != nil {
+			log.Printf("ERROR Backup:%s: %s", table.Name, err)
+			return 1
+		}
+		raw, err := json.Marshal(rows)
+		if err != nil {
+			log.Printf("ERROR Backup:%s: %s", table.Name, err)
+			return 1
+		}
+		archive.Tables[table.Name] = raw
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(archive); err != nil {
+		log.Printf("ERROR Backup:Encode: %s", err)
+		return 1
+	}
+
+	log.Printf("INFO  Backup complete")
+	return 0
+}
+
+func RestoreCommand(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := flags.Bool("force", false, "overwrite a non-empty database")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: postfix-go restore [-force] <file>\n")
+		return 2
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Printf("ERROR Restore: %s", err)
+		return 1
+	}
+	defer file.Close()
+
+	archive := BackupArchive{}
+	if err := json.NewDecoder(file).Decode(&archive); err != nil {
+		log.Printf("ERROR Restore:Decode: %s", err)
+		return 1
+	}
+	if archive.Format != BackupFormat || archive.Version > BackupVersion {
+		log.Printf("ERROR Restore: unsupported archive %s version %d", archive.Format, archive.Version)
+		return 1
+	}
+	if archive.Schema > MigrateLatest() {
+		log.Printf("ERROR Restore: archive schema %d is newer than %d", archive.Schema, MigrateLatest())
+		return 1
+	}
+	log.Printf("INFO  Restore %s backup from %s", archive.DB_Type, archive.CreatedAt)
+
+	tables := make(map[string]interface{})
+	for _, table := range BackupTables {
+		rows := table.Rows()
+		if raw, ok := archive.Tables[table.Name]; ok {
+			if err := json.Unmarshal(raw, rows); err != nil {
+				log.Printf("ERROR Restore:%s: %s", table.Name, err)
+				return 1
+			}
+		}
+		tables[table.Name] = rows
+	}
+
+	if err := RestoreCheck(tables); err != nil {
+		log.Printf("ERROR Restore: %s", err)
+		return 1
+	}
+
+	db := OpenDB(nil, false)
+	defer CloseDB(db)
+
+	if err := MigrateUp(db); err != nil {
+		log.Printf("ERROR Restore:MigrateUp: %s", err)
+		return 1
+	}
+
+	for _, table := range BackupTables {
+		count := 0
+		db.Model(table.Model).Count(&count)
+		if count > 0 && !*force {
+			log.Printf("ERROR Restore: table %s is not empty (use -force)", table.Name)
+			return 1
+		}
+	}
+
+	tx := db.Begin()
+	for index := len(BackupTables) - 1; index >= 0; index-- {
+		table := BackupTables[index]
+		if err := tx.Delete(table.Model).Error; err != nil {
+			tx.Rollback()
+			log.Printf("ERROR Restore:Delete %s: %s", table.Name, err)
+			return 1
+		}
+	}
+	for _, table := range BackupTables {
+		if err := RestoreRows(tx, tables[table.Name]); err != nil {
+			tx.Rollback()
+			log.Printf("ERROR Restore:Create %s: %s", table.Name, err)
+			return 1
+		}
+	}
+	if err := tx.Delete(&RelayRecipient{}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("ERROR Restore:Delete relay_recipients: %s", err)
+		return 1
+	}
+	for _, domain := range *tables["domains"].(*[]Domain) {
+		if err := DomainRelaySync(&domain, tx); err != nil {
+			tx.Rollback()
+			log.Printf("ERROR Restore:Relay %s: %s", domain.Name, err)
+			return 1
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("ERROR Restore:Commit: %s", err)
+		return 1
+	}
+
+	// PostgreSQL sequences don't notice explicitly inserted IDs
+	if DB_Type == "postgres" {
+		for _, table := range BackupTables {
+			sql := fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s",
+				table.Name, table.Name)
+			if err := db.Exec(sql).Error; err != nil {
+				log.Printf("ERROR Restore:Sequence %s: %s", table.Name, err)
+				return 1
+			}
+		}
+	}
+
+	log.Printf("INFO  Restore complete")
+	return 0
+}
+
+func RestoreRows(tx *gorm.DB, rows interface{}) error {
+	slice := reflect.ValueOf(rows).Elem()
+	for index := 0; index < slice.Len(); index++ {
+		if err := tx.Create(slice.Index(index).Addr().Interface()).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreCheck verifies that every DomainID and AddressID
+// refers to a record contained in the archive.
+func RestoreCheck(tables map[string]interface{}) error {
+	domains := make(map[int]bool)
+	for _, domain := range *tables["domains"].(*[]Domain) {
+		domains[domain.ID] = true
+	}
+
+	addresses := make(map[int]bool)
+	for _, address := range *tables["addresses"].(*[]Address) {
+		if !domains[address.DomainID] {
+			return fmt.Errorf("address %s: domain %d missing", address.Email, address.DomainID)
+		}
+		addresses[address.ID] = true
+	}
+
+	for _, alias := range *tables["aliases"].(*[]Alias) {
+		if !domains[alias.DomainID] {
+			return fmt.Errorf("alias %s: domain %d missing", alias.Email, alias.DomainID)
+		}
+		if !addresses[alias.AddressID] {
+			return fmt.Errorf("alias %s: address %d missing", alias.Email, alias.AddressID)
+		}
+	}
+
+	// DomainID 0 holds the defaults for all domains
+	for _, notice := range *tables["notices"].(*[]Notice) {
+		if notice.DomainID != 0 && !domains[notice.DomainID] {
+			return fmt.Errorf("notice %s/%s: domain %d missing", notice.Kind, notice.Language, notice.DomainID)
+		}
+	}
+
+	return nil
+}
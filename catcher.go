@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+	"bytes"
+	"strings"
+	"net/mail"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"encoding/base64"
+)
+
+// Only the latest messages are kept
+const CATCHER_MAX = 200
+
+type CaughtPart struct {
+	ContentType   string
+	Filename      string
+	Size          int
+}
+
+// CaughtMail is a message the catcher transport kept instead
+// of sending it, split up for display.
+type CaughtMail struct {
+	ID            int
+	At            time.Time
+	From          string
+	To            []string
+	Subject       string
+	Header        mail.Header
+	Text          string
+	HTML          string
+	Parts         []CaughtPart
+	Raw           string
+}
+
+// MailCatcher is the transport for development: every message stays
+// in memory and can be looked at in the admin UI, nothing is sent.
+type MailCatcher struct {
+	mutex         sync.Mutex
+	next          int
+	mails         []CaughtMail
+}
+
+var Mail_Catcher *MailCatcher
+
+func (t *MailCatcher) Name() string {
+	return "catcher"
+}
+
+func (t *MailCatcher) Send(from string, to []string, body []byte) error {
+	caught := CatcherParse(body)
+	caught.At = time.Now()
+	caught.From = from
+	caught.To = to
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.next++
+	caught.ID = t.next
+	t.mails = append(t.mails, caught)
+	if len(t.mails) > CATCHER_MAX {
+		t.mails = t.mails[len(t.mails) - CATCHER_MAX:]
+	}
+	log.Printf("INFO  Catcher: caught %d for %s", caught.ID, strings.Join(to, ", "))
+
+	return nil
+}
+
+// List returns the messages, newest first.
+func (t *MailCatcher) List() []CaughtMail {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	list := make([]CaughtMail, len(t.mails))
+	for index, caught := range t.mails {
+		list[len(t.mails) - 1 - index] = caught
+	}
+	return list
+}
+
+func (t *MailCatcher) Find(id int) *CaughtMail {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, caught := range t.mails {
+		if caught.ID == id {
+			return &caught
+		}
+	}
+	return nil
+}
+
+func (t *MailCatcher) Clear() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.mails = nil
+}
+
+// CatcherParse splits a message into headers, text and HTML body,
+// other parts (attachments) are only listed.
+func CatcherParse(raw []byte) CaughtMail {
+	caught := CaughtMail{Raw: string(raw)}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		log.Printf("ERROR CatcherParse: %s", err)
+		caught.Text = string(raw)
+		return caught
+	}
+	caught.Header = msg.Header
+
+	dec := mime.WordDecoder{}
+	if subject, err := dec.DecodeHeader(msg.Header.Get("Subject")); err == nil {
+		caught.Subject = subject
+	} else {
+		caught.Subject = msg.Header.Get("Subject")
+	}
+
+	CatcherPart(&caught, msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), "", msg.Body)
+
+	return caught
+}
+
+func CatcherPart(caught *CaughtMail, content_type, encoding, disposition string, body io.Reader) {
+	media, params, err := mime.ParseMediaType(content_type)
+	if err != nil {
+		media = "text/plain"
+	}
+
+	if strings.HasPrefix(media, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("ERROR CatcherPart: %s", err)
+				}
+				return
+			}
+			CatcherPart(caught, part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Disposition"), part)
+		}
+	}
+
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		log.Printf("ERROR CatcherPart: %s", err)
+	}
+
+	_, disp_params, _ := mime.ParseMediaType(disposition)
+	attached := strings.HasPrefix(disposition, "attachment")
+	switch {
+	case media == "text/plain" && !attached && caught.Text == "":
+		caught.Text = string(data)
+	case media == "text/html" && !attached && caught.HTML == "":
+		caught.HTML = string(data)
+	default:
+		filename := disp_params["filename"]
+		if filename == "" {
+			filename = params["name"]
+		}
+		caught.Parts = append(caught.Parts, CaughtPart{ContentType: media, Filename: filename, Size: len(data)})
+	}
+}
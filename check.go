@@ -0,0 +1,322 @@
+package main
+
+import (
+	"os"
+	"log"
+	"fmt"
+	"flag"
+	"net/http"
+	"github.com/julienschmidt/httprouter"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	CHECK_EMAIL          = "check_email"
+	CHECK_DOMAIN_NAME    = "check_domain_name"
+	CHECK_DESTINATION    = "check_destination"
+	CHECK_ORPHAN_DOMAIN  = "check_orphan_domain"
+	CHECK_ORPHAN_ADDRESS = "check_orphan_address"
+	CHECK_SHADOW         = "check_shadow"
+)
+
+type CheckIssue struct {
+	Kind          string
+	Table         string
+	ID            int
+	Email         string
+	Have          string
+	Want          string
+	Repair        func(tx *gorm.DB) error
+}
+
+func CheckURL() string {
+	return Base_URL + "check"
+}
+
+// CheckRun compares the denormalized columns of addresses and aliases
+// with the records they were copied from. Expected values are kept in
+// memory, so an alias is checked against the repaired address email.
+func CheckRun(db *gorm.DB) ([]CheckIssue, error) {
+	issues := []CheckIssue{}
+
+	domain_list := []Domain{}
+	if err := db.Find(&domain_list).Error; err != nil {
+		return nil, err
+	}
+	domains := make(map[int]*Domain)
+	for index, _ := range domain_list {
+		domains[domain_list[index].ID] = &domain_list[index]
+	}
+
+	address_list := []Address{}
+	if err := db.Order("email").Find(&address_list).Error; err != nil {
+		return nil, err
+	}
+	addresses := make(map[int]*Address)
+	mailboxes := make(map[string]bool)
+	for index, _ := range address_list {
+		address := &address_list[index]
+		addresses[address.ID] = address
+
+		domain, ok := domains[address.DomainID]
+		if !ok {
+			issues = append(issues, CheckIssue{
+				Kind:  CHECK_ORPHAN_DOMAIN,
+				Table: "addresses",
+				ID:    address.ID,
+				Email: address.Email,
+				Have:  fmt.Sprintf("%d", address.DomainID),
+			})
+			mailboxes[address.Email] = true
+			continue
+		}
+
+		if address.DomainName != domain.Name {
+			issues = append(issues, CheckIssue{
+				Kind:   CHECK_DOMAIN_NAME,
+				Table:  "addresses",
+				ID:     address.ID,
+				Email:  address.Email,
+				Have:   address.DomainName,
+				Want:   domain.Name,
+				Repair: CheckUpdate(&Address{ID: address.ID}, "domain_name", domain.Name),
+			})
+			address.DomainName = domain.Name
+		}
+
+		email := fmt.Sprintf("%s@%s", address.LocalPart, domain.Name)
+		if address.Email != email {
+			issues = append(issues, CheckIssue{
+				Kind:   CHECK_EMAIL,
+				Table:  "addresses",
+				ID:     address.ID,
+				Email:  address.Email,
+				Have:   address.Email,
+				Want:   email,
+				Repair: CheckUpdate(&Address{ID: address.ID}, "email", email),
+			})
+			address.Email = email
+		}
+		mailboxes[address.Email] = true
+	}
+
+	aliases := []Alias{}
+	if err := db.Order("email").Find(&aliases).Error; err != nil {
+		return nil, err
+	}
+	for _, alias := range aliases {
+		address, ok := addresses[alias.AddressID]
+		if !ok {
+			issues = append(issues, CheckIssue{
+				Kind:   CHECK_ORPHAN_ADDRESS,
+				Table:  "aliases",
+				ID:     alias.ID,
+				Email:  alias.Email,
+				Have:   fmt.Sprintf("%d", alias.AddressID),
+				Repair: CheckDelete(&Alias{ID: alias.ID}),
+			})
+			continue
+		}
+
+		// Aliases always live in the domain of their address
+		domain, ok := domains[alias.DomainID]
+		if !ok {
+			domain, ok = domains[address.DomainID]
+			if !ok {
+				issues = append(issues, CheckIssue{
+					Kind:  CHECK_ORPHAN_DOMAIN,
+					Table: "aliases",
+					ID:    alias.ID,
+					Email: alias.Email,
+					Have:  fmt.Sprintf("%d", alias.DomainID),
+				})
+				continue
+			}
+			issues = append(issues, CheckIssue{
+				Kind:   CHECK_ORPHAN_DOMAIN,
+				Table:  "aliases",
+				ID:     alias.ID,
+				Email:  alias.Email,
+				Have:   fmt.Sprintf("%d", alias.DomainID),
+				Want:   fmt.Sprintf("%d", domain.ID),
+				Repair: CheckUpdate(&Alias{ID: alias.ID}, "domain_id", domain.ID),
+			})
+		}
+
+		if alias.DomainName != domain.Name {
+			issues = append(issues, CheckIssue{
+				Kind:   CHECK_DOMAIN_NAME,
+				Table:  "aliases",
+				ID:     alias.ID,
+				Email:  alias.Email,
+				Have:   alias.DomainName,
+				Want:   domain.Name,
+				Repair: CheckUpdate(&Alias{ID: alias.ID}, "domain_name", domain.Name),
+			})
+		}
+
+		email := fmt.Sprintf("%s@%s", alias.LocalPart, domain.Name)
+		if mailboxes[email] {
+			issues = append(issues, CheckIssue{
+				Kind:   CHECK_SHADOW,
+				Table:  "aliases",
+				ID:     alias.ID,
+				Email:  alias.Email,
+				Have:   alias.Destination,
+				Repair: CheckDelete(&Alias{ID: alias.ID}),
+			})
+			continue
+		}
+
+		if alias.Email != email {
+			issues = append(issues, CheckIssue{
+				Kind:   CHECK_EMAIL,
+				Table:  "aliases",
+				ID:     alias.ID,
+				Email:  alias.Email,
+				Have:   alias.Email,
+				Want:   email,
+				Repair: CheckUpdate(&Alias{ID: alias.ID}, "email", email),
+			})
+		}
+
+		if alias.Destination != address.Email {
+			issues = append(issues, CheckIssue{
+				Kind:   CHECK_DESTINATION,
+				Table:  "aliases",
+				ID:     alias.ID,
+				Email:  alias.Email,
+				Have:   alias.Destination,
+				Want:   address.Email,
+				Repair: CheckUpdate(&Alias{ID: alias.ID}, "destination", address.Email),
+			})
+		}
+	}
+
+	return issues, nil
+}
+
+func CheckUpdate(model interface{}, column string, value interface{}) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		return tx.Model(model).UpdateColumn(column, value).Error
+	}
+}
+
+func CheckDelete(model interface{}) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		return tx.Delete(model).Error
+	}
+}
+
+// CheckRepair fixes all repairable issues in one transaction and
+// returns the number of repairs. Orphaned addresses are left alone,
+// deleting a mailbox needs a human decision.
+func CheckRepair(db *gorm.DB) (int, error) {
+	tx := db.Begin()
+
+	issues, err := CheckRun(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	repaired := 0
+	for _, issue := range issues {
+		if issue.Repair == nil {
+			continue
+		}
+		log.Printf("INFO  CheckRepair: %s %d %s (%s)", issue.Table, issue.ID, issue.Email, issue.Kind)
+		if err := issue.Repair(tx); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("%s %s: %s", issue.Table, issue.Email, err)
+		}
+		repaired++
+	}
+
+	return repaired, tx.Commit().Error
+}
+
+func CheckCommand(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair the issues found")
+	flags.Parse(args)
+
+	db := OpenDB(nil, false)
+	defer CloseDB(db)
+
+	if *repair {
+		repaired, err := CheckRepair(db)
+		if err != nil {
+			log.Printf("ERROR Check:Repair: %s", err)
+			return 1
+		}
+		log.Printf("INFO  Check: %d issue(s) repaired", repaired)
+	}
+
+	issues, err := CheckRun(db)
+	if err != nil {
+		log.Printf("ERROR Check: %s", err)
+		return 1
+	}
+	for _, issue := range issues {
+		fmt.Printf("%-20s %-9s %5d  %-40s %s -> %s\n", issue.Kind, issue.Table, issue.ID, issue.Email, issue.Have, issue.Want)
+	}
+	if len(issues) > 0 {
+		fmt.Fprintf(os.Stderr, "%d issue(s) found\n", len(issues))
+		return 1
+	}
+
+	log.Printf("INFO  Check: no issues found")
+	return 0
+}
+
+func CheckShow(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	t := RequestTfunc(r)
+	log.Printf("INFO  GET %s", CheckURL())
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "check_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	issues, err := CheckRun(db)
+	if err != nil {
+		log.Printf("ERROR CheckShow: %s", err)
+		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HomeURL(), http.StatusFound)
+		return
+	}
+	ctx.CheckIssues = issues
+
+	RenderHtml(w, r, "check", ctx)
+}
+
+func CheckRepairPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	t := RequestTfunc(r)
+	log.Printf("INFO  POST %s", CheckURL())
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "check_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	repaired, err := CheckRepair(db)
+	if err != nil {
+		log.Printf("ERROR CheckRepairPost: %s", err)
+		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, CheckURL(), http.StatusFound)
+		return
+	}
+
+	flash := fmt.Sprintf(t("check_repaired", repaired), repaired)
+	SetFlash(w, F_INFO, flash)
+	http.Redirect(w, r, CheckURL(), http.StatusFound)
+}
@@ -10,7 +10,6 @@ import (
 	"net/http"
 	"github.com/julienschmidt/httprouter"
 	"github.com/jinzhu/gorm"
-	"github.com/nicksnyder/go-i18n/i18n"
 )
 
 type Address struct {
@@ -28,24 +27,23 @@ type Address struct {
 	Sha512        string
 	Initial       string
 	Admin         bool
+	MsgLimit      int
+	RcptLimit     int
+	Suspended     bool
+	Language      string
 	// Computed values
-	Domain        *Domain
-	Aliases       []Alias
-	AliasList     string      `sql:"-"`
-	ConfirmDelete string      `sql:"-"`
-	Base_URL      string      `sql:"-"`
+	Domain        *Domain     `json:"-"`
+	Aliases       []Alias     `json:"-"`
+	AliasList     string      `sql:"-" json:"-"`
+	ConfirmDelete string      `sql:"-" json:"-"`
+	Base_URL      string      `sql:"-" json:"-"`
 }
 
 func AddressInit() {
-	t, _ := i18n.Tfunc(Language)
+	t := LanguageTfunc(Language)
 
-	db := OpenDB(true)
-	defer CloseDB()
-
-	if err := db.AutoMigrate(&Address{}).Error; err != nil {
-		log.Printf("FATAL AddressInit:AutoMigrate: %s", err)
-		os.Exit(1)
-	}
+	db := OpenDB(nil, true)
+	defer CloseDB(db)
 
 	addresses := []Address{}
 	if err := db.Find(&addresses).Error; err != nil {
@@ -94,8 +92,6 @@ func AddressInit() {
 }
 
 func (address *Address) AddressSetup(db *gorm.DB) {
-	t, _ := i18n.Tfunc(Language)
-
 	domain := &Domain{}
 	db.Find(domain, address.DomainID)
 	address.Domain = domain
@@ -106,8 +102,28 @@ func (address *Address) AddressSetup(db *gorm.DB) {
 	}
 	address.Aliases = aliases
 
+	address.AddressDecorate(db)
+}
+
+// AddressPreload loads domain and aliases along with the addresses,
+// so lists don't need AddressSetup (and its queries) per address.
+func AddressPreload(db *gorm.DB) *gorm.DB {
+	return db.Preload("Domain").Preload("Aliases", func(db *gorm.DB) *gorm.DB {
+		return db.Order("local_part")
+	})
+}
+
+// AddressDecorate fills in the computed values that
+// don't need further queries.
+func (address *Address) AddressDecorate(db *gorm.DB) {
+	t := DBTfunc(db)
+
+	if address.Domain != nil {
+		address.Domain.DomainDecorate(db)
+	}
+
 	address.AliasList = ""
-	for _, alias := range aliases {
+	for _, alias := range address.Aliases {
 		if address.AliasList != "" {
 			address.AliasList += "\n"
 		}
@@ -147,7 +163,7 @@ func AddressIsLoggedIn(r *http.Request, db *gorm.DB) (*Address, bool) {
 }
 
 func AddressContext(w http.ResponseWriter, r *http.Request, title string, need_admin bool, db *gorm.DB) Context {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 
 	ctx := Context{
 		Title:          title,
@@ -177,11 +193,11 @@ func AddressContext(w http.ResponseWriter, r *http.Request, title string, need_a
 }
 
 func AddressCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 	log.Printf("INFO  GET %saddress", Base_URL)
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	ctx := AddressContext(w, r, "address_create", true, db)
 	if !ctx.LoggedIn {
@@ -201,12 +217,12 @@ func AddressCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 }
 
 func AddressEdit(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 	id, _ := strconv.Atoi(ps.ByName("id"))
 	log.Printf("INFO  GET %saddress/%d", Base_URL, id)
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	ctx := AddressContext(w, r, "address_edit", true, db)
 	if !ctx.LoggedIn {
@@ -221,17 +237,18 @@ func AddressEdit(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	}
 	ctx.Address.AddressSetup(db)
 	ctx.Domains = DomainFindAll(db, ctx.Address.DomainName)
+	ctx.Stats = StatsAddress(ctx.Address, db)
 
 	RenderHtml(w, r, "address_edit", ctx)
 }
 
 func AddressUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 	id, _ := strconv.Atoi(ps.ByName("id"))
 	log.Printf("INFO  POST %saddress/%d", Base_URL, id)
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	ctx := AddressContext(w, r, "address_update", true, db)
 	if !ctx.LoggedIn {
@@ -246,19 +263,42 @@ func AddressUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		http.Redirect(w, r, HomeURL(), http.StatusFound)
 		return
 	}
+	if !domain.IsMailbox() {
+		flash := fmt.Sprintf(t("flash_domain_no_mailbox"), domain.Name)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HomeURL(), http.StatusFound)
+		return
+	}
 
 	local_part  := r.FormValue("address_local_part")
 	email       := fmt.Sprintf("%s@%s", local_part, domain.Name)
 	admin       := r.FormValue("address_admin")
 	other_email := r.FormValue("address_other_email")
+	suspended   := r.FormValue("address_suspended") == "yes"
+	language    := LanguageMatch(r.FormValue("address_language"))
+	msg_limit, _  := strconv.Atoi(r.FormValue("address_msg_limit"))
+	rcpt_limit, _ := strconv.Atoi(r.FormValue("address_rcpt_limit"))
 	//log.Printf("DEBUG LocalPart=%s DomainName=%s Admin=%s", local_part, domain.Name, admin)
 
+	if !ImportLocalPart.MatchString(local_part) {
+		flash := fmt.Sprintf(t("import_bad_local_part"), local_part)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HomeURL(), http.StatusFound)
+		return
+	}
+
 	alias_names := []string{}
 	for _, alias_name := range strings.Split(r.FormValue("address_alias_list"), "\n") {
 		alias_name = strings.TrimSpace(alias_name)
 		if alias_name == "" || alias_name == local_part {
 			continue
 		}
+		if !ImportLocalPart.MatchString(alias_name) {
+			flash := fmt.Sprintf(t("import_bad_local_part"), alias_name)
+			SetFlash(w, F_ERROR, flash)
+			http.Redirect(w, r, HomeURL(), http.StatusFound)
+			return
+		}
 		if flash := AliasCheck(alias_name, domain.Name, id, db); flash != "" {
 			SetFlash(w, F_ERROR, flash)
 			http.Redirect(w, r, HomeURL(), http.StatusFound)
@@ -283,25 +323,67 @@ func AddressUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 			OtherEmail: other_email,
 			DomainID:   domain.ID,
 			Admin:      admin == "yes",
+			MsgLimit:   msg_limit,
+			RcptLimit:  rcpt_limit,
+			Suspended:  suspended,
+			Language:   language,
 			CreatedBy:  ctx.CurrentAddress.ID,
 			UpdatedBy:  ctx.CurrentAddress.ID,
 		}
-		if err := db.Create(address).Error; err != nil {
+		tx := db.Begin()
+		if err := AddressSave(address, nil, alias_names, tx); err != nil {
+			tx.Rollback()
+			log.Printf("ERROR AddressUpdate:AddressSave: %s", err)
 			flash := fmt.Sprintf(t("flash_error_text"), err.Error())
-			if strings.Index(err.Error(), "UNIQUE") >= 0 {
+			if alias_err, ok := err.(*AliasError); ok {
+				flash = alias_err.Flash
+			} else if DBIsUnique(err) {
 				flash = fmt.Sprintf(t("flash_error_exists"), email)
 			}
 			SetFlash(w, F_ERROR, flash)
 			http.Redirect(w, r, HomeURL(), http.StatusFound)
 			return
 		}
+		if err := tx.Commit().Error; err != nil {
+			flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+			SetFlash(w, F_ERROR, flash)
+			http.Redirect(w, r, HomeURL(), http.StatusFound)
+			return
+		}
 
-		for _, alias_name := range alias_names {
-			if flash := AliasCreate(address, alias_name, db); flash != "" {
-				SetFlash(w, F_ERROR, flash)
-				http.Redirect(w, r, HomeURL(), http.StatusFound)
-				return
-			}
+		WebhookFire(&WebhookPayload{
+			Event:   WEBHOOK_ADDRESS_CREATED,
+			Actor:   ctx.CurrentAddress.Email,
+			Address: WebhookAddressOf(address, ""),
+		}, db)
+
+		// The hooks may outlast the database deadline of the request
+		bg := OpenDB(nil, true)
+		defer CloseDB(bg)
+
+		// A failed hook doesn't keep the address from being onboarded
+		errs := []string{}
+		back := HomeURL()
+		if err := HookFire(HOOK_CREATE, address.ID, address.Email, ""); err != nil {
+			errs = append(errs, err.Error())
+			back = HookURL()
+		}
+		if err := Onboard(address, ctx.CurrentAddress.ID, bg); err != nil {
+			errs = append(errs, err.Error())
+		}
+		if len(errs) > 0 {
+			flash := fmt.Sprintf(t("flash_onboard_failed"), address.Email, strings.Join(errs, "; "))
+			SetFlash(w, F_ERROR, flash)
+			http.Redirect(w, r, back, http.StatusFound)
+			return
+		}
+
+		// Nobody to mail the interim password to, so it has to be printed
+		if OnboardEnabled(ONBOARD_PASSWORD) && address.OtherEmail == "" {
+			flash := fmt.Sprintf(t("flash_created_print"), address.Email)
+			SetFlash(w, F_INFO, flash)
+			http.Redirect(w, r, fmt.Sprintf("%saddress/%d", Base_URL, address.ID), http.StatusFound)
+			return
 		}
 
 		flash := fmt.Sprintf(t("flash_created"), address.Email)
@@ -318,6 +400,10 @@ func AddressUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		return
 	}
 
+	old_email := address.Email
+	old_other_email := address.OtherEmail
+	old_domain_id := address.DomainID
+
 	update := make(map[string]interface{})
 	if address.LocalPart != local_part {
 		update["local_part"] = local_part
@@ -341,24 +427,73 @@ func AddressUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 			update["admin"] = false
 		}
 	}
+	if address.MsgLimit != msg_limit {
+		update["msg_limit"] = msg_limit
+	}
+	if address.RcptLimit != rcpt_limit {
+		update["rcpt_limit"] = rcpt_limit
+	}
+	if address.Language != language {
+		update["language"] = language
+	}
+	if address.Suspended != suspended {
+		update["suspended"] = suspended
+		if !suspended {
+			PolicyReset(fmt.Sprintf("address:%d", address.ID))
+		}
+	}
 	update["updated_at"] = time.Now()
 	update["updated_by"] = ctx.CurrentAddress.ID
 
-	if err := db.Model(address).Updates(update).Error; err != nil {
+	tx := db.Begin()
+	if err := AddressSave(address, update, alias_names, tx); err != nil {
+		tx.Rollback()
+		log.Printf("ERROR AddressUpdate:AddressSave: %s", err)
 		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
-		if strings.Index(err.Error(), "UNIQUE") >= 0 {
+		if alias_err, ok := err.(*AliasError); ok {
+			flash = alias_err.Flash
+		} else if DBIsUnique(err) {
 			flash = fmt.Sprintf(t("flash_error_exists"), email)
 		}
 		SetFlash(w, F_ERROR, flash)
 		http.Redirect(w, r, HomeURL(), http.StatusFound)
 		return
 	}
+	if err := tx.Commit().Error; err != nil {
+		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HomeURL(), http.StatusFound)
+		return
+	}
 
-	db.Where("address_id = ?", address.ID).Delete(&Alias{})
-	for _, alias_name := range alias_names {
-		if flash := AliasCreate(address, alias_name, db); flash != "" {
+	// Both the old and the new recovery address learn about the change
+	if old_other_email != other_email {
+		AddressRecoveryNotice(id, old_other_email, db)
+	}
+
+	if old_email != email {
+		WebhookFire(&WebhookPayload{
+			Event:   WEBHOOK_ADDRESS_RENAMED,
+			Actor:   ctx.CurrentAddress.Email,
+			Address: WebhookAddressOf(address, old_email),
+		}, db)
+	} else {
+		WebhookFire(&WebhookPayload{
+			Event:   WEBHOOK_ADDRESS_UPDATED,
+			Actor:   ctx.CurrentAddress.Email,
+			Address: WebhookAddressOf(address, ""),
+		}, db)
+	}
+
+	if old_email != email {
+		event := HOOK_RENAME
+		if old_domain_id != domain.ID {
+			event = HOOK_MOVE
+		}
+		if err := HookFire(event, id, email, old_email); err != nil {
+			flash := fmt.Sprintf(t("flash_hook_failed"), email, err.Error())
 			SetFlash(w, F_ERROR, flash)
-			http.Redirect(w, r, HomeURL(), http.StatusFound)
+			http.Redirect(w, r, HookURL(), http.StatusFound)
 			return
 		}
 	}
@@ -368,13 +503,62 @@ func AddressUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	http.Redirect(w, r, HomeURL(), http.StatusFound)
 }
 
+func AddressRecoveryNotice(id int, old_email string, db *gorm.DB) {
+	address := AddressFindByID(id, db)
+	if address == nil {
+		return
+	}
+
+	to := []string{}
+	for _, email := range []string{old_email, address.OtherEmail} {
+		if email != "" {
+			to = append(to, email)
+		}
+	}
+	if len(to) == 0 {
+		return
+	}
+
+	data := NoticeDataNew(address, db)
+	data.OldEmail = old_email
+	if err := NoticeSend(NOTICE_RECOVERY, address, to, data, db); err != nil {
+		log.Printf("ERROR AddressRecoveryNotice: %s", err)
+	}
+}
+
+// AddressSave creates address (if its ID is 0) or applies update
+// to it, and replaces its aliases by alias_names. It is meant to run
+// inside a transaction, so any error leaves nothing half done.
+func AddressSave(address *Address, update map[string]interface{}, alias_names []string, tx *gorm.DB) error {
+	if address.ID == 0 {
+		if err := tx.Create(address).Error; err != nil {
+			return err
+		}
+	} else {
+		if err := tx.Model(address).Updates(update).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("address_id = ?", address.ID).Delete(&Alias{}).Error; err != nil {
+			return err
+		}
+	}
+
+	for _, alias_name := range alias_names {
+		if flash := AliasCreate(address, alias_name, tx); flash != "" {
+			return &AliasError{Flash: flash}
+		}
+	}
+
+	return nil
+}
+
 func AddressPrint(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 	id, _ := strconv.Atoi(ps.ByName("id"))
 	log.Printf("INFO  GET %saddress/%d/print", Base_URL, id)
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	ctx := AddressContext(w, r, "address_print", true, db)
 	if !ctx.LoggedIn {
@@ -388,29 +572,24 @@ func AddressPrint(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		return
 	}
 
-	initial := PasswordRandom(10)
-	update := make(map[string]interface{})
-	update["initial"] = PasswordBcrypt(ctx.Address.Email, initial)
-	update["updated_at"] = time.Now()
-	update["updated_by"] = ctx.CurrentAddress.ID
-
-	if err := db.Model(ctx.Address).Updates(update).Error; err != nil {
+	initial, err := AddressInitial(ctx.Address, ctx.CurrentAddress.ID, db)
+	if err != nil {
 		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
 		SetFlash(w, F_ERROR, flash)
 		http.Redirect(w, r, HomeURL(), http.StatusFound)
 		return
 	}
 
-	PasswordLetter(w, ctx, initial)
+	PasswordLetter(w, ctx.Address, initial, db)
 }
 
 func AddressDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 	id, _ := strconv.Atoi(ps.ByName("id"))
 	log.Printf("INFO  GET %saddress/%d/delete", Base_URL, id)
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	ctx := AddressContext(w, r, "address_delete", true, db)
 	if !ctx.LoggedIn {
@@ -438,12 +617,25 @@ func AddressDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	}
 
 	email := ctx.Address.Email
+	payload := &WebhookPayload{
+		Event:   WEBHOOK_ADDRESS_DELETED,
+		Actor:   ctx.CurrentAddress.Email,
+		Address: WebhookAddressOf(ctx.Address, ""),
+	}
 	if err := db.Delete(ctx.Address).Error; err != nil {
 		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
 		SetFlash(w, F_ERROR, flash)
 		http.Redirect(w, r, HomeURL(), http.StatusFound)
 		return
 	}
+	WebhookFire(payload, db)
+
+	if err := HookFire(HOOK_DELETE, id, email, ""); err != nil {
+		flash := fmt.Sprintf(t("flash_hook_failed"), email, err.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HookURL(), http.StatusFound)
+		return
+	}
 
 	flash := fmt.Sprintf(t("flash_deleted"), email)
 	SetFlash(w, F_INFO, flash)
@@ -5,9 +5,7 @@ import (
 	"log"
 	"fmt"
 	"time"
-	"strings"
 	"github.com/jinzhu/gorm"
-	"github.com/nicksnyder/go-i18n/i18n"
 )
 
 type Alias struct {
@@ -23,18 +21,13 @@ type Alias struct {
 	DomainID      int         `gorm:"index"`
 	AddressID     int         `gorm:"index"`
 	// Computed values
-	Domain        *Domain
-	Address       *Address
+	Domain        *Domain     `json:"-"`
+	Address       *Address    `json:"-"`
 }
 
 func AliasInit() {
-	db := OpenDB(true)
-	defer CloseDB()
-
-	if err := db.AutoMigrate(&Alias{}).Error; err != nil {
-		log.Printf("FATAL AliasInit:AutoMigrate: %s", err)
-		os.Exit(1)
-	}
+	db := OpenDB(nil, true)
+	defer CloseDB(db)
 
 	aliases := []Alias{}
 	if err := db.Find(&aliases).Error; err != nil {
@@ -60,7 +53,7 @@ func AliasFindByEmail(email string, db *gorm.DB) *Alias {
 }
 
 func AliasCheck(local_part, domain_name string, destination_id int, db *gorm.DB) string {
-	t, _ := i18n.Tfunc(Language)
+	t := DBTfunc(db)
 
 	email := fmt.Sprintf("%s@%s", local_part, domain_name)
 
@@ -85,8 +78,18 @@ func AliasCheck(local_part, domain_name string, destination_id int, db *gorm.DB)
 	return ""
 }
 
+// AliasError carries the flash of AliasCreate, which is translated
+// already, through AddressSave.
+type AliasError struct {
+	Flash         string
+}
+
+func (err *AliasError) Error() string {
+	return err.Flash
+}
+
 func AliasCreate(destination *Address, local_part string, db *gorm.DB) string {
-	t, _ := i18n.Tfunc(Language)
+	t := DBTfunc(db)
 
 	email := fmt.Sprintf("%s@%s", local_part, destination.DomainName)
 	log.Printf("INFO  creating alias %s for %s", email, destination.Email)
@@ -104,7 +107,7 @@ func AliasCreate(destination *Address, local_part string, db *gorm.DB) string {
 	if err := db.Create(&alias).Error; err != nil {
 		log.Printf("ERROR AliasCreate: %s", err)
 		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
-		if strings.Index(err.Error(), "UNIQUE") >= 0 {
+		if DBIsUnique(err) {
 			flash = fmt.Sprintf(t("flash_error_exists"), email)
 		}
 		return flash
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"io"
+	"log"
+	"fmt"
+	"net"
+	"bytes"
+	"strings"
+	"strconv"
+	"net/http"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"text/template"
+	"github.com/julienschmidt/httprouter"
+	"github.com/gorilla/csrf"
+)
+
+type MailSettings struct {
+	Email          string
+	DomainName     string
+	ImapHost       string
+	ImapPort       int
+	ImapSecurity   string
+	SubmitHost     string
+	SubmitPort     int
+	SubmitSecurity string
+	UUID           string
+}
+
+const thunderbirdXML = `<?xml version="1.0" encoding="UTF-8"?>
+<clientConfig version="1.1">
+  <emailProvider id="{{x .DomainName}}">
+    <domain>{{x .DomainName}}</domain>
+    <displayName>{{x .DomainName}}</displayName>
+    <incomingServer type="imap">
+      <hostname>{{x .ImapHost}}</hostname>
+      <port>{{.ImapPort}}</port>
+      <socketType>{{x .ImapSecurity}}</socketType>
+      <username>%EMAILADDRESS%</username>
+      <authentication>password-cleartext</authentication>
+    </incomingServer>
+    <outgoingServer type="smtp">
+      <hostname>{{x .SubmitHost}}</hostname>
+      <port>{{.SubmitPort}}</port>
+      <socketType>{{x .SubmitSecurity}}</socketType>
+      <username>%EMAILADDRESS%</username>
+      <authentication>password-cleartext</authentication>
+    </outgoingServer>
+  </emailProvider>
+</clientConfig>
+`
+
+const autodiscoverXML = `<?xml version="1.0" encoding="UTF-8"?>
+<Autodiscover xmlns="http://schemas.microsoft.com/exchange/autodiscover/responseschema/2006">
+  <Response xmlns="http://schemas.microsoft.com/exchange/autodiscover/outlook/responseschema/2006a">
+    <Account>
+      <AccountType>email</AccountType>
+      <Action>settings</Action>
+      <Protocol>
+        <Type>IMAP</Type>
+        <Server>{{x .ImapHost}}</Server>
+        <Port>{{.ImapPort}}</Port>
+        <LoginName>{{x .Email}}</LoginName>
+        <DomainRequired>off</DomainRequired>
+        <SPA>off</SPA>
+        <SSL>{{if eq .ImapSecurity "plain"}}off{{else}}on{{end}}</SSL>
+        <Encryption>{{if eq .ImapSecurity "STARTTLS"}}TLS{{else}}{{if eq .ImapSecurity "SSL"}}SSL{{else}}None{{end}}{{end}}</Encryption>
+        <AuthRequired>on</AuthRequired>
+      </Protocol>
+      <Protocol>
+        <Type>SMTP</Type>
+        <Server>{{x .SubmitHost}}</Server>
+        <Port>{{.SubmitPort}}</Port>
+        <LoginName>{{x .Email}}</LoginName>
+        <DomainRequired>off</DomainRequired>
+        <SPA>off</SPA>
+        <SSL>{{if eq .SubmitSecurity "plain"}}off{{else}}on{{end}}</SSL>
+        <Encryption>{{if eq .SubmitSecurity "STARTTLS"}}TLS{{else}}{{if eq .SubmitSecurity "SSL"}}SSL{{else}}None{{end}}{{end}}</Encryption>
+        <AuthRequired>on</AuthRequired>
+        <UsePOPAuth>off</UsePOPAuth>
+        <SMTPLast>off</SMTPLast>
+      </Protocol>
+    </Account>
+  </Response>
+</Autodiscover>
+`
+
+const mobileconfigXML = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+  <key>PayloadContent</key>
+  <array>
+    <dict>
+      <key>EmailAccountDescription</key>
+      <string>{{x .Email}}</string>
+      <key>EmailAccountType</key>
+      <string>EmailTypeIMAP</string>
+      <key>EmailAddress</key>
+      <string>{{x .Email}}</string>
+      <key>IncomingMailServerAuthentication</key>
+      <string>EmailAuthPassword</string>
+      <key>IncomingMailServerHostName</key>
+      <string>{{x .ImapHost}}</string>
+      <key>IncomingMailServerPortNumber</key>
+      <integer>{{.ImapPort}}</integer>
+      <key>IncomingMailServerUseSSL</key>
+      {{if eq .ImapSecurity "plain"}}<false/>{{else}}<true/>{{end}}
+      <key>IncomingMailServerUsername</key>
+      <string>{{x .Email}}</string>
+      <key>OutgoingMailServerAuthentication</key>
+      <string>EmailAuthPassword</string>
+      <key>OutgoingMailServerHostName</key>
+      <string>{{x .SubmitHost}}</string>
+      <key>OutgoingMailServerPortNumber</key>
+      <integer>{{.SubmitPort}}</integer>
+      <key>OutgoingMailServerUseSSL</key>
+      {{if eq .SubmitSecurity "plain"}}<false/>{{else}}<true/>{{end}}
+      <key>OutgoingMailServerUsername</key>
+      <string>{{x .Email}}</string>
+      <key>OutgoingPasswordSameAsIncomingPassword</key>
+      <true/>
+      <key>PayloadIdentifier</key>
+      <string>{{x .DomainName}}.postfix-go.email.{{.UUID}}</string>
+      <key>PayloadType</key>
+      <string>com.apple.mail.managed</string>
+      <key>PayloadUUID</key>
+      <string>{{.UUID}}</string>
+      <key>PayloadVersion</key>
+      <integer>1</integer>
+    </dict>
+  </array>
+  <key>PayloadDisplayName</key>
+  <string>{{x .Email}}</string>
+  <key>PayloadIdentifier</key>
+  <string>{{x .DomainName}}.postfix-go.{{.UUID}}</string>
+  <key>PayloadType</key>
+  <string>Configuration</string>
+  <key>PayloadUUID</key>
+  <string>{{.UUID}}</string>
+  <key>PayloadVersion</key>
+  <integer>1</integer>
+</dict>
+</plist>
+`
+
+var autoconfigTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"x": func(s string) string {
+		buf := bytes.Buffer{}
+		xml.EscapeText(&buf, []byte(s))
+		return buf.String()
+	},
+}).Parse(`{{define "thunderbird"}}` + thunderbirdXML + `{{end}}` +
+	`{{define "autodiscover"}}` + autodiscoverXML + `{{end}}` +
+	`{{define "mobileconfig"}}` + mobileconfigXML + `{{end}}`))
+
+// CsrfExempt lets mail clients POST to the autodiscover endpoint,
+// they can't know about our CSRF token.
+func CsrfExempt(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(strings.ToLower(r.URL.Path), "/autodiscover/") {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (domain *Domain) MailSettings(email string) MailSettings {
+	settings := MailSettings{
+		Email:          email,
+		DomainName:     domain.Name,
+		ImapHost:       IMAP_Host,
+		ImapPort:       IMAP_Port,
+		ImapSecurity:   IMAP_Security,
+		SubmitHost:     Submit_Host,
+		SubmitPort:     Submit_Port,
+		SubmitSecurity: Submit_Security,
+	}
+
+	if domain.ImapHost != "" {
+		settings.ImapHost = domain.ImapHost
+	}
+	if domain.ImapPort != 0 {
+		settings.ImapPort = domain.ImapPort
+	}
+	if domain.ImapSecurity != "" {
+		settings.ImapSecurity = domain.ImapSecurity
+	}
+	if domain.SubmitHost != "" {
+		settings.SubmitHost = domain.SubmitHost
+	}
+	if domain.SubmitPort != 0 {
+		settings.SubmitPort = domain.SubmitPort
+	}
+	if domain.SubmitSecurity != "" {
+		settings.SubmitSecurity = domain.SubmitSecurity
+	}
+
+	// A stable UUID, so re-installing the profile replaces the old one
+	sum := sha256.Sum256([]byte(email))
+	h := hex.EncodeToString(sum[:16])
+	settings.UUID = strings.ToUpper(fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32]))
+
+	return settings
+}
+
+func AutoconfigDomain(r *http.Request, email string) string {
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		return strings.ToLower(email[at+1:])
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	host = strings.TrimPrefix(host, "autoconfig.")
+	host = strings.TrimPrefix(host, "autodiscover.")
+
+	return host
+}
+
+func AutoconfigThunderbird(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	email := r.FormValue("emailaddress")
+	log.Printf("INFO  GET %s (%s)", r.URL.Path, email)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	domain := DomainFindByName(AutoconfigDomain(r, email), db)
+	if domain == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	if err := autoconfigTemplates.ExecuteTemplate(w, "thunderbird", domain.MailSettings(email)); err != nil {
+		log.Printf("ERROR AutoconfigThunderbird: %s", err)
+	}
+}
+
+func AutoconfigAutodiscover(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	request := struct {
+		EMailAddress string `xml:"Request>EMailAddress"`
+	}{}
+	body, _ := io.ReadAll(io.LimitReader(r.Body, 64 * 1024))
+	if err := xml.Unmarshal(body, &request); err != nil {
+		log.Printf("DEBUG AutoconfigAutodiscover:Unmarshal: %s", err)
+	}
+	email := strings.TrimSpace(request.EMailAddress)
+	log.Printf("INFO  POST %s (%s)", r.URL.Path, email)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	domain := DomainFindByName(AutoconfigDomain(r, email), db)
+	if domain == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	if err := autoconfigTemplates.ExecuteTemplate(w, "autodiscover", domain.MailSettings(email)); err != nil {
+		log.Printf("ERROR AutoconfigAutodiscover: %s", err)
+	}
+}
+
+func AutoconfigMobileconfig(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t := RequestTfunc(r)
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	log.Printf("INFO  GET %saddress/%d/mobileconfig", Base_URL, id)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "address_mobileconfig", false, db)
+	if !ctx.LoggedIn {
+		return
+	}
+	if ctx.CurrentAddress.Admin == false && ctx.CurrentAddress.ID != id {
+		SetFlash(w, F_ERROR, t("flash_forbidden"))
+		http.Redirect(w, r, PasswordURL(), http.StatusFound)
+		return
+	}
+
+	if ctx.Address = AddressFindByID(id, db); ctx.Address == nil {
+		flash := fmt.Sprintf(t("flash_address_not_found"), id)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HomeURL(), http.StatusFound)
+		return
+	}
+	ctx.Address.AddressSetup(db)
+
+	settings := ctx.Address.Domain.MailSettings(ctx.Address.Email)
+	w.Header().Set("Content-Type", "application/x-apple-aspen-config")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.mobileconfig\"", ctx.Address.Email))
+	if err := autoconfigTemplates.ExecuteTemplate(w, "mobileconfig", settings); err != nil {
+		log.Printf("ERROR AutoconfigMobileconfig: %s", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"fmt"
+	"strconv"
+	"net/http"
+	"github.com/julienschmidt/httprouter"
+)
+
+func CatcherURL() string {
+	return Base_URL + "catcher"
+}
+
+// CatcherContext is AddressContext for the catcher pages, which
+// only exist while Mail_Transport is catcher.
+func CatcherContext(w http.ResponseWriter, r *http.Request) (Context, bool) {
+	t := RequestTfunc(r)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "catcher_title", true, db)
+	if !ctx.LoggedIn {
+		return ctx, false
+	}
+
+	if Mail_Catcher == nil {
+		SetFlash(w, F_ERROR, t("catcher_inactive"))
+		http.Redirect(w, r, HomeURL(), http.StatusFound)
+		return ctx, false
+	}
+
+	return ctx, true
+}
+
+func CatcherList(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Printf("INFO  GET %s", CatcherURL())
+
+	ctx, ok := CatcherContext(w, r)
+	if !ok {
+		return
+	}
+	ctx.CaughtMails = Mail_Catcher.List()
+
+	RenderHtml(w, r, "catcher", ctx)
+}
+
+func CatcherShow(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t := RequestTfunc(r)
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	log.Printf("INFO  GET %scatcher/%d", Base_URL, id)
+
+	ctx, ok := CatcherContext(w, r)
+	if !ok {
+		return
+	}
+
+	if ctx.CaughtMail = Mail_Catcher.Find(id); ctx.CaughtMail == nil {
+		flash := fmt.Sprintf(t("flash_mail_not_found"), id)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, CatcherURL(), http.StatusFound)
+		return
+	}
+
+	RenderHtml(w, r, "catcher_show", ctx)
+}
+
+func CatcherClear(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	t := RequestTfunc(r)
+	log.Printf("INFO  POST %scatcher/clear", Base_URL)
+
+	if _, ok := CatcherContext(w, r); !ok {
+		return
+	}
+	Mail_Catcher.Clear()
+
+	SetFlash(w, F_INFO, t("catcher_cleared"))
+	http.Redirect(w, r, CatcherURL(), http.StatusFound)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"log"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"strings"
+	"strconv"
+	"context"
+	"net/http"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	DNS_OK      = "ok"
+	DNS_MISSING = "missing"
+	DNS_DIFFERS = "differs"
+)
+
+type DnsRecord struct {
+	Name          string
+	Type          string
+	Value         string
+	Live          []string
+	Status        string
+}
+
+type DnsResolver interface {
+	LookupMX(name string) ([]string, error)
+	LookupTXT(name string) ([]string, error)
+	LookupCNAME(name string) (string, error)
+}
+
+// DnsNetResolver asks the system resolver or, if Server is set,
+// the given name server (host:port) directly.
+type DnsNetResolver struct {
+	Server        string
+	Timeout       time.Duration
+}
+
+// DnsStubResolver answers from static maps, so the check
+// can run offline. Keys are fully qualified names without
+// the trailing dot.
+type DnsStubResolver struct {
+	MX            map[string][]string
+	TXT           map[string][]string
+	CNAME         map[string]string
+}
+
+var (
+	Resolver      DnsResolver
+	DNS_Mutex     = &sync.Mutex{}
+	DNS_Broken    = make(map[string]bool)
+)
+
+func (res *DnsNetResolver) resolver() *net.Resolver {
+	if res.Server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, res.Server)
+		},
+	}
+}
+
+func (res *DnsNetResolver) LookupMX(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), res.Timeout)
+	defer cancel()
+
+	mxs, err := res.resolver().LookupMX(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	hosts := []string{}
+	for _, mx := range mxs {
+		hosts = append(hosts, fmt.Sprintf("%d %s", mx.Pref, strings.TrimSuffix(mx.Host, ".")))
+	}
+	return hosts, nil
+}
+
+func (res *DnsNetResolver) LookupTXT(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), res.Timeout)
+	defer cancel()
+
+	return res.resolver().LookupTXT(ctx, name)
+}
+
+func (res *DnsNetResolver) LookupCNAME(name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), res.Timeout)
+	defer cancel()
+
+	cname, err := res.resolver().LookupCNAME(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(cname, "."), nil
+}
+
+func (res *DnsStubResolver) LookupMX(name string) ([]string, error) {
+	if hosts, ok := res.MX[name]; ok {
+		return hosts, nil
+	}
+	return nil, fmt.Errorf("no MX for %s", name)
+}
+
+func (res *DnsStubResolver) LookupTXT(name string) ([]string, error) {
+	if txts, ok := res.TXT[name]; ok {
+		return txts, nil
+	}
+	return nil, fmt.Errorf("no TXT for %s", name)
+}
+
+func (res *DnsStubResolver) LookupCNAME(name string) (string, error) {
+	if cname, ok := res.CNAME[name]; ok {
+		return cname, nil
+	}
+	return "", fmt.Errorf("no CNAME for %s", name)
+}
+
+func DnsInit() {
+	Resolver = &DnsNetResolver{
+		Server:  DNS_Resolver,
+		Timeout: 5 * time.Second,
+	}
+
+	if DNS_Interval > 0 {
+		go DnsChecker()
+	}
+}
+
+func DnsChecker() {
+	for {
+		db := OpenDB(nil, false)
+		domains := []Domain{}
+		if err := db.Find(&domains).Error; err != nil {
+			log.Printf("ERROR DnsChecker: %s", err)
+		}
+		CloseDB(db)
+
+		for index, _ := range domains {
+			DomainDnsCheck(&domains[index], Resolver)
+		}
+
+		time.Sleep(time.Duration(DNS_Interval) * time.Minute)
+	}
+}
+
+func DnsIsBroken(name string) bool {
+	DNS_Mutex.Lock()
+	defer DNS_Mutex.Unlock()
+
+	return DNS_Broken[name]
+}
+
+func DomainDnsRecords(domain *Domain) []DnsRecord {
+	records := []DnsRecord{
+		{
+			Name:  domain.Name,
+			Type:  "MX",
+			Value: fmt.Sprintf("10 %s", MX_Host),
+		},
+		{
+			Name:  domain.Name,
+			Type:  "TXT",
+			Value: "v=spf1 mx -all",
+		},
+	}
+
+	if DKIM_PubKey != "" {
+		records = append(records, DnsRecord{
+			Name:  fmt.Sprintf("%s._domainkey.%s", DKIM_Selector, domain.Name),
+			Type:  "TXT",
+			Value: fmt.Sprintf("v=DKIM1; k=rsa; p=%s", DKIM_PubKey),
+		})
+	}
+
+	records = append(records, []DnsRecord{
+		{
+			Name:  "_dmarc." + domain.Name,
+			Type:  "TXT",
+			Value: fmt.Sprintf("v=DMARC1; p=%s; rua=mailto:postmaster@%s", DMARC_Policy, domain.Name),
+		},
+		{
+			Name:  "_mta-sts." + domain.Name,
+			Type:  "TXT",
+			Value: fmt.Sprintf("v=STSv1; id=%s", domain.StsPolicyID()),
+		},
+		{
+			Name:  "mta-sts." + domain.Name,
+			Type:  "CNAME",
+			Value: Web_Host,
+		},
+		{
+			Name:  "autoconfig." + domain.Name,
+			Type:  "CNAME",
+			Value: Web_Host,
+		},
+	}...)
+
+	return records
+}
+
+func DomainDnsZone(records []DnsRecord) string {
+	zone := ""
+	for _, record := range records {
+		value := record.Value
+		switch record.Type {
+		case "TXT":
+			value = strconv.Quote(value)
+		case "MX", "CNAME":
+			value += "."
+		}
+		zone += fmt.Sprintf("%-40s IN %-5s %s\n", record.Name + ".", record.Type, value)
+	}
+	return zone
+}
+
+func DomainDnsCheck(domain *Domain, resolver DnsResolver) []DnsRecord {
+	records := DomainDnsRecords(domain)
+	broken := false
+
+	for index, _ := range records {
+		record := &records[index]
+
+		var err error
+		switch record.Type {
+		case "MX":
+			record.Live, err = resolver.LookupMX(record.Name)
+		case "TXT":
+			record.Live, err = resolver.LookupTXT(record.Name)
+		case "CNAME":
+			var cname string
+			if cname, err = resolver.LookupCNAME(record.Name); err == nil {
+				record.Live = []string{cname}
+			}
+		}
+		if err != nil {
+			log.Printf("DEBUG DomainDnsCheck %s %s: %s", record.Type, record.Name, err)
+		}
+
+		record.Status = DnsCompare(record)
+		if record.Status != DNS_OK {
+			broken = true
+		}
+	}
+
+	DNS_Mutex.Lock()
+	DNS_Broken[domain.Name] = broken
+	DNS_Mutex.Unlock()
+
+	return records
+}
+
+func DnsCompare(record *DnsRecord) string {
+	if len(record.Live) == 0 {
+		return DNS_MISSING
+	}
+
+	// Several TXT records may share one name (e.g. SPF and
+	// site verification), so only compare those of our kind.
+	prefix := record.Value
+	if record.Type == "TXT" {
+		prefix = strings.SplitN(record.Value, ";", 2)[0]
+		prefix = strings.SplitN(prefix, " ", 2)[0]
+	}
+
+	found := []string{}
+	for _, live := range record.Live {
+		if strings.HasPrefix(live, prefix) || record.Type != "TXT" {
+			found = append(found, live)
+		}
+	}
+	if len(found) == 0 {
+		return DNS_MISSING
+	}
+
+	if len(found) == 1 && strings.EqualFold(found[0], record.Value) {
+		return DNS_OK
+	}
+	return DNS_DIFFERS
+}
+
+func DomainDns(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t := RequestTfunc(r)
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	log.Printf("INFO  GET %sdomain/%d/dns", Base_URL, id)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "domain_dns", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	if ctx.Domain = DomainFindByID(id, db); ctx.Domain == nil {
+		flash := fmt.Sprintf(t("flash_domain_not_found"), id)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HomeURL(), http.StatusFound)
+		return
+	}
+	ctx.Domain.DomainSetup(db)
+
+	ctx.DnsRecords = DomainDnsCheck(ctx.Domain, Resolver)
+	ctx.Zone = DomainDnsZone(ctx.DnsRecords)
+
+	RenderHtml(w, r, "domain_dns", ctx)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"testing"
+)
+
+func dnsTestSetup() *Domain {
+	MX_Host       = "mail.example.net"
+	Web_Host      = "mail.example.net"
+	DKIM_Selector = "mail"
+	DKIM_PubKey   = "MIIBIjANBgkq"
+	DMARC_Policy  = "quarantine"
+	STS_Mode      = "enforce"
+	STS_MaxAge    = 604800
+
+	return &Domain{Name: "example.com"}
+}
+
+// dnsTestStub answers exactly what DomainDnsRecords asks for
+func dnsTestStub(domain *Domain) *DnsStubResolver {
+	stub := &DnsStubResolver{
+		MX:    make(map[string][]string),
+		TXT:   make(map[string][]string),
+		CNAME: make(map[string]string),
+	}
+	for _, record := range DomainDnsRecords(domain) {
+		switch record.Type {
+		case "MX":
+			stub.MX[record.Name] = append(stub.MX[record.Name], record.Value)
+		case "TXT":
+			stub.TXT[record.Name] = append(stub.TXT[record.Name], record.Value)
+		case "CNAME":
+			stub.CNAME[record.Name] = record.Value
+		}
+	}
+	return stub
+}
+
+func TestDomainDnsCheck(t *testing.T) {
+	domain := dnsTestSetup()
+	policy := "v=STSv1; id=" + domain.StsPolicyID()
+
+	tests := []struct {
+		name   string
+		change func(stub *DnsStubResolver)
+		record string
+		status string
+	}{
+		{"all matching", func(stub *DnsStubResolver) {}, "", DNS_OK},
+		{"mx missing", func(stub *DnsStubResolver) {
+			delete(stub.MX, "example.com")
+		}, "MX example.com", DNS_MISSING},
+		{"mx wrong host", func(stub *DnsStubResolver) {
+			stub.MX["example.com"] = []string{"10 mx.other.org"}
+		}, "MX example.com", DNS_DIFFERS},
+		{"mx extra host", func(stub *DnsStubResolver) {
+			stub.MX["example.com"] = []string{"10 mail.example.net", "20 backup.example.net"}
+		}, "MX example.com", DNS_DIFFERS},
+		{"spf missing, other txt kept", func(stub *DnsStubResolver) {
+			stub.TXT["example.com"] = []string{"google-site-verification=abc"}
+		}, "TXT example.com", DNS_MISSING},
+		{"spf next to other txt", func(stub *DnsStubResolver) {
+			stub.TXT["example.com"] = []string{"google-site-verification=abc", "v=spf1 mx -all"}
+		}, "", DNS_OK},
+		{"spf wrong", func(stub *DnsStubResolver) {
+			stub.TXT["example.com"] = []string{"v=spf1 a mx ~all"}
+		}, "TXT example.com", DNS_DIFFERS},
+		{"spf twice", func(stub *DnsStubResolver) {
+			stub.TXT["example.com"] = []string{"v=spf1 mx -all", "v=spf1 a -all"}
+		}, "TXT example.com", DNS_DIFFERS},
+		{"dkim missing", func(stub *DnsStubResolver) {
+			delete(stub.TXT, "mail._domainkey.example.com")
+		}, "TXT mail._domainkey.example.com", DNS_MISSING},
+		{"dkim old key", func(stub *DnsStubResolver) {
+			stub.TXT["mail._domainkey.example.com"] = []string{"v=DKIM1; k=rsa; p=OLDKEY"}
+		}, "TXT mail._domainkey.example.com", DNS_DIFFERS},
+		{"dmarc missing", func(stub *DnsStubResolver) {
+			delete(stub.TXT, "_dmarc.example.com")
+		}, "TXT _dmarc.example.com", DNS_MISSING},
+		{"dmarc policy none", func(stub *DnsStubResolver) {
+			stub.TXT["_dmarc.example.com"] = []string{"v=DMARC1; p=none; rua=mailto:postmaster@example.com"}
+		}, "TXT _dmarc.example.com", DNS_DIFFERS},
+		{"dmarc case insensitive", func(stub *DnsStubResolver) {
+			stub.TXT["_dmarc.example.com"] = []string{"v=DMARC1; p=QUARANTINE; rua=mailto:postmaster@example.com"}
+		}, "", DNS_OK},
+		{"mta-sts id missing", func(stub *DnsStubResolver) {
+			delete(stub.TXT, "_mta-sts.example.com")
+		}, "TXT _mta-sts.example.com", DNS_MISSING},
+		{"mta-sts id outdated", func(stub *DnsStubResolver) {
+			stub.TXT["_mta-sts.example.com"] = []string{"v=STSv1; id=20190101"}
+		}, "TXT _mta-sts.example.com", DNS_DIFFERS},
+		{"mta-sts host missing", func(stub *DnsStubResolver) {
+			delete(stub.CNAME, "mta-sts.example.com")
+		}, "CNAME mta-sts.example.com", DNS_MISSING},
+		{"autoconfig elsewhere", func(stub *DnsStubResolver) {
+			stub.CNAME["autoconfig.example.com"] = "web.other.org"
+		}, "CNAME autoconfig.example.com", DNS_DIFFERS},
+	}
+
+	for _, test := range tests {
+		stub := dnsTestStub(domain)
+		test.change(stub)
+
+		records := DomainDnsCheck(domain, stub)
+		for _, record := range records {
+			want := DNS_OK
+			if record.Type + " " + record.Name == test.record {
+				want = test.status
+			}
+			if record.Status != want {
+				t.Errorf("%s: %s %s is %s, want %s (live %v)", test.name, record.Type, record.Name, record.Status, want, record.Live)
+			}
+		}
+		if DnsIsBroken(domain.Name) != (test.status != DNS_OK) {
+			t.Errorf("%s: DnsIsBroken is %v", test.name, DnsIsBroken(domain.Name))
+		}
+	}
+
+	if records := DomainDnsCheck(domain, dnsTestStub(domain)); records[4].Value != policy {
+		t.Errorf("mta-sts record is %q, want %q", records[4].Value, policy)
+	}
+}
+
+func TestDomainDnsWithoutDkim(t *testing.T) {
+	domain := dnsTestSetup()
+	DKIM_PubKey = ""
+
+	for _, record := range DomainDnsCheck(domain, dnsTestStub(domain)) {
+		if record.Name == "mail._domainkey.example.com" {
+			t.Errorf("DKIM record checked without a key")
+		}
+		if record.Status != DNS_OK {
+			t.Errorf("%s %s is %s", record.Type, record.Name, record.Status)
+		}
+	}
+}
+
+func TestDnsCompare(t *testing.T) {
+	tests := []struct {
+		record DnsRecord
+		status string
+	}{
+		{DnsRecord{Type: "MX", Value: "10 mail.example.net"}, DNS_MISSING},
+		{DnsRecord{Type: "MX", Value: "10 mail.example.net", Live: []string{"10 MAIL.example.net"}}, DNS_OK},
+		{DnsRecord{Type: "CNAME", Value: "mail.example.net", Live: []string{"www.example.net"}}, DNS_DIFFERS},
+		{DnsRecord{Type: "TXT", Value: "v=spf1 mx -all", Live: []string{"v=DMARC1; p=none"}}, DNS_MISSING},
+		{DnsRecord{Type: "TXT", Value: "v=DMARC1; p=reject", Live: []string{"v=DMARC1; p=reject"}}, DNS_OK},
+	}
+
+	for _, test := range tests {
+		if status := DnsCompare(&test.record); status != test.status {
+			t.Errorf("%s %q against %v: %s, want %s", test.record.Type, test.record.Value, test.record.Live, status, test.status)
+		}
+	}
+}
@@ -10,7 +10,12 @@ import (
 	"net/http"
 	"github.com/julienschmidt/httprouter"
 	"github.com/jinzhu/gorm"
-	"github.com/nicksnyder/go-i18n/i18n"
+)
+
+const (
+	DOMAIN_MAILBOX = "mailbox"
+	DOMAIN_RELAY   = "relay"
+	DOMAIN_BACKUP  = "backup"
 )
 
 type Domain struct {
@@ -20,22 +25,41 @@ type Domain struct {
 	CreatedBy     int         `gorm:"index"`
 	UpdatedAt     time.Time
 	UpdatedBy     int         `gorm:"index"`
+	StsMode       string
+	StsMaxAge     int
+	StsMX         string
+	ImapHost      string
+	ImapPort      int
+	ImapSecurity  string
+	SubmitHost    string
+	SubmitPort    int
+	SubmitSecurity string
+	DomainType    string
+	Transport     string
+	RelayRecipients string
+	MsgLimit      int
+	RcptLimit     int
 	// Computed values
-	Addresses     []Address
-	AddressCount  int         `sql:"-"`
-	Selected      bool        `sql:"-"`
-	ConfirmDelete string      `sql:"-"`
-	Base_URL      string      `sql:"-"`
+	Addresses     []Address   `json:"-"`
+	AddressCount  int         `sql:"-" json:"-"`
+	Selected      bool        `sql:"-" json:"-"`
+	DnsBroken     bool        `sql:"-" json:"-"`
+	ConfirmDelete string      `sql:"-" json:"-"`
+	Base_URL      string      `sql:"-" json:"-"`
 }
 
-func DomainInit() {
-	db := OpenDB(true)
-	defer CloseDB()
+// RelayRecipient is one accepted recipient of a relay or backup
+// domain, kept in step with Domain.RelayRecipients for the
+// postfix_relay_recipients view.
+type RelayRecipient struct {
+	ID            int         `gorm:"primary_key"`
+	DomainID      int         `gorm:"index"`
+	Email         string
+}
 
-	if err := db.AutoMigrate(&Domain{}).Error; err != nil {
-		log.Printf("FATAL DomainInit:AutoMigrate: %s", err)
-		os.Exit(1)
-	}
+func DomainInit() {
+	db := OpenDB(nil, true)
+	defer CloseDB(db)
 
 	domains := []Domain{}
 	if err := db.Find(&domains).Error; err != nil {
@@ -45,9 +69,10 @@ func DomainInit() {
 
 	if len(domains) == 0 {
 		domain := Domain{
-			Name:      Def_Domain,
-			CreatedBy: 1,
-			UpdatedBy: 1,
+			Name:       Def_Domain,
+			CreatedBy:  1,
+			UpdatedBy:  1,
+			DomainType: DOMAIN_MAILBOX,
 		}
 		if err := db.Create(&domain).Error; err != nil {
 			log.Printf("FATAL DomainInit:Create: %s", err)
@@ -57,18 +82,63 @@ func DomainInit() {
 }
 
 func (domain *Domain) DomainSetup(db *gorm.DB) {
-	t, _ := i18n.Tfunc(Language)
-
 	addresses := []Address{}
 	if err := db.Where("domain_id = ?", domain.ID).Order("local_part").Find(&addresses).Error; err != nil {
 		log.Printf("ERROR DomainSetup:Addresses: %s", err)
 	}
 	domain.Addresses = addresses
+	domain.AddressCount = len(addresses)
+
+	domain.DomainDecorate(db)
+}
+
+// DomainDecorate fills in the computed values that
+// don't need further queries.
+func (domain *Domain) DomainDecorate(db *gorm.DB) {
+	t := DBTfunc(db)
 
+	domain.DnsBroken = DnsIsBroken(domain.Name)
 	domain.ConfirmDelete = fmt.Sprintf(t("delete_are_you_sure"), domain.Name)
 	domain.Base_URL = Base_URL
 }
 
+// IsMailbox tells whether the domain may have addresses,
+// relay and backup MX domains only pass mail on.
+func (domain *Domain) IsMailbox() bool {
+	return domain.DomainType == DOMAIN_MAILBOX || domain.DomainType == ""
+}
+
+// RelayRecipientList expands the recipients of a relay domain, a
+// bare local part belongs to the domain itself.
+func RelayRecipientList(name, recipients string) []string {
+	list := []string{}
+	for _, recipient := range strings.Fields(recipients) {
+		if !strings.Contains(recipient, "@") {
+			recipient = fmt.Sprintf("%s@%s", recipient, name)
+		}
+		list = append(list, recipient)
+	}
+	return list
+}
+
+// DomainRelaySync replaces the relay recipients of domain. Without
+// any the view accepts every recipient of a relay domain.
+func DomainRelaySync(domain *Domain, tx *gorm.DB) error {
+	if err := tx.Where("domain_id = ?", domain.ID).Delete(&RelayRecipient{}).Error; err != nil {
+		return err
+	}
+	if domain.IsMailbox() {
+		return nil
+	}
+
+	for _, email := range RelayRecipientList(domain.Name, domain.RelayRecipients) {
+		if err := tx.Create(&RelayRecipient{DomainID: domain.ID, Email: email}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func DomainFindByID(id int, db *gorm.DB) *Domain {
 	domain := &Domain{}
 	if err := db.First(domain, id).Error; err != nil {
@@ -93,20 +163,59 @@ func DomainFindAll(db *gorm.DB, name string) []Domain {
 		log.Printf("ERROR DomainFindAll: %s", err)
 	}
 
+	counts := DomainCounts(db)
 	for index, _ := range domains {
 		domain := &domains[index]
-		domain.DomainSetup(db)
+		domain.AddressCount = counts[domain.ID]
+		domain.DomainDecorate(db)
 		domain.Selected = (domain.Name == name)
 	}
 
 	return domains
 }
 
+// DomainCounts returns the number of addresses per domain ID.
+func DomainCounts(db *gorm.DB) map[int]int {
+	counts := make(map[int]int)
+
+	rows, err := db.Model(&Address{}).Select("domain_id, COUNT(*)").Group("domain_id").Rows()
+	if err != nil {
+		log.Printf("ERROR DomainCounts: %s", err)
+		return counts
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var domain_id, count int
+		if err := rows.Scan(&domain_id, &count); err != nil {
+			log.Printf("ERROR DomainCounts:Scan: %s", err)
+			continue
+		}
+		counts[domain_id] = count
+	}
+
+	return counts
+}
+
+// DomainFindEmpty returns all domains without addresses.
+func DomainFindEmpty(db *gorm.DB) []Domain {
+	domains := []Domain{}
+	if err := db.Where("id NOT IN (?)", db.Table("addresses").Select("domain_id").QueryExpr()).Order("name").Find(&domains).Error; err != nil {
+		log.Printf("ERROR DomainFindEmpty: %s", err)
+	}
+
+	for index, _ := range domains {
+		domains[index].DomainDecorate(db)
+	}
+
+	return domains
+}
+
 func DomainCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Printf("INFO  GET %sdomain", Base_URL)
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	ctx := AddressContext(w, r, "domain_create", true, db)
 	if !ctx.LoggedIn {
@@ -117,18 +226,21 @@ func DomainCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		ID:        0,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
+		StsMode:   STS_Mode,
+		StsMaxAge: STS_MaxAge,
+		DomainType: DOMAIN_MAILBOX,
 	}
 
 	RenderHtml(w, r, "domain_edit", ctx)
 }
 
 func DomainEdit(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 	id, _ := strconv.Atoi(ps.ByName("id"))
 	log.Printf("INFO  GET %sdomain/%d", Base_URL, id)
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	ctx := AddressContext(w, r, "domain_edit", true, db)
 	if !ctx.LoggedIn {
@@ -142,17 +254,26 @@ func DomainEdit(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 	ctx.Domain.DomainSetup(db)
+	if ctx.Domain.StsMode == "" {
+		ctx.Domain.StsMode = STS_Mode
+	}
+	if ctx.Domain.StsMaxAge == 0 {
+		ctx.Domain.StsMaxAge = STS_MaxAge
+	}
+	if ctx.Domain.DomainType == "" {
+		ctx.Domain.DomainType = DOMAIN_MAILBOX
+	}
 
 	RenderHtml(w, r, "domain_edit", ctx)
 }
 
 func DomainUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 	id, _ := strconv.Atoi(ps.ByName("id"))
 	log.Printf("INFO  POST %sdomain/%d", Base_URL, id)
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	ctx := AddressContext(w, r, "domain_update", true, db)
 	if !ctx.LoggedIn {
@@ -160,16 +281,61 @@ func DomainUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	}
 
 	name := r.FormValue("domain_name")
+	sts_mode := r.FormValue("domain_sts_mode")
+	sts_max_age, _ := strconv.Atoi(r.FormValue("domain_sts_max_age"))
+	sts_mx := strings.Join(strings.Fields(r.FormValue("domain_sts_mx")), "\n")
+	imap_host := strings.TrimSpace(r.FormValue("domain_imap_host"))
+	imap_port, _ := strconv.Atoi(r.FormValue("domain_imap_port"))
+	imap_security := r.FormValue("domain_imap_security")
+	submit_host := strings.TrimSpace(r.FormValue("domain_submit_host"))
+	submit_port, _ := strconv.Atoi(r.FormValue("domain_submit_port"))
+	submit_security := r.FormValue("domain_submit_security")
+	domain_type := r.FormValue("domain_type")
+	transport := strings.TrimSpace(r.FormValue("domain_transport"))
+	relay_recipients := strings.Join(strings.Fields(r.FormValue("domain_relay_recipients")), "\n")
+	msg_limit, _ := strconv.Atoi(r.FormValue("domain_msg_limit"))
+	rcpt_limit, _ := strconv.Atoi(r.FormValue("domain_rcpt_limit"))
+
+	if domain_type != DOMAIN_RELAY && domain_type != DOMAIN_BACKUP {
+		domain_type = DOMAIN_MAILBOX
+	}
+	if domain_type == DOMAIN_MAILBOX {
+		relay_recipients = ""
+	}
 
 	if id == 0 {
 		domain := &Domain{
 			Name:      name,
 			CreatedBy: ctx.CurrentAddress.ID,
 			UpdatedBy: ctx.CurrentAddress.ID,
+			StsMode:   sts_mode,
+			StsMaxAge: sts_max_age,
+			StsMX:     sts_mx,
+			ImapHost:       imap_host,
+			ImapPort:       imap_port,
+			ImapSecurity:   imap_security,
+			SubmitHost:     submit_host,
+			SubmitPort:     submit_port,
+			SubmitSecurity: submit_security,
+			DomainType:     domain_type,
+			Transport:      transport,
+			RelayRecipients: relay_recipients,
+			MsgLimit:       msg_limit,
+			RcptLimit:      rcpt_limit,
+		}
+		tx := db.Begin()
+		err := tx.Create(domain).Error
+		if err == nil {
+			err = DomainRelaySync(domain, tx)
+		}
+		if err == nil {
+			err = tx.Commit().Error
+		} else {
+			tx.Rollback()
 		}
-		if err := db.Create(domain).Error; err != nil {
+		if err != nil {
 			flash := fmt.Sprintf(t("flash_error_text"), err.Error())
-			if strings.Index(err.Error(), "UNIQUE") >= 0 {
+			if DBIsUnique(err) {
 				flash = fmt.Sprintf(t("flash_error_exists"), name)
 			}
 			SetFlash(w, F_ERROR, flash)
@@ -177,6 +343,12 @@ func DomainUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 			return
 		}
 
+		WebhookFire(&WebhookPayload{
+			Event:  WEBHOOK_DOMAIN_CREATED,
+			Actor:  ctx.CurrentAddress.Email,
+			Domain: WebhookDomainOf(domain, ""),
+		}, db)
+
 		flash := fmt.Sprintf(t("flash_created"), domain.Name)
 		SetFlash(w, F_INFO, flash)
 		http.Redirect(w, r, HomeURL(), http.StatusFound)
@@ -191,80 +363,202 @@ func DomainUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		return
 	}
 
-	if domain.Name == name {
-		http.Redirect(w, r, HomeURL(), http.StatusFound)
-		return
+	if domain_type != DOMAIN_MAILBOX && domain.IsMailbox() {
+		count := 0
+		db.Model(&Address{}).Where("domain_id = ?", domain.ID).Count(&count)
+		if count > 0 {
+			flash := fmt.Sprintf(t("flash_domain_not_empty"), domain.Name)
+			SetFlash(w, F_ERROR, flash)
+			http.Redirect(w, r, HomeURL(), http.StatusFound)
+			return
+		}
 	}
 
 	update := make(map[string]interface{})
-	update["name"] = name
+	if domain.StsMode != sts_mode {
+		update["sts_mode"] = sts_mode
+	}
+	if domain.StsMaxAge != sts_max_age {
+		update["sts_max_age"] = sts_max_age
+	}
+	if domain.StsMX != sts_mx {
+		update["sts_mx"] = sts_mx
+	}
+	if domain.ImapHost != imap_host {
+		update["imap_host"] = imap_host
+	}
+	if domain.ImapPort != imap_port {
+		update["imap_port"] = imap_port
+	}
+	if domain.ImapSecurity != imap_security {
+		update["imap_security"] = imap_security
+	}
+	if domain.SubmitHost != submit_host {
+		update["submit_host"] = submit_host
+	}
+	if domain.SubmitPort != submit_port {
+		update["submit_port"] = submit_port
+	}
+	if domain.SubmitSecurity != submit_security {
+		update["submit_security"] = submit_security
+	}
+	if domain.DomainType != domain_type {
+		update["domain_type"] = domain_type
+	}
+	if domain.Transport != transport {
+		update["transport"] = transport
+	}
+	if domain.RelayRecipients != relay_recipients {
+		update["relay_recipients"] = relay_recipients
+	}
+	if domain.MsgLimit != msg_limit {
+		update["msg_limit"] = msg_limit
+	}
+	if domain.RcptLimit != rcpt_limit {
+		update["rcpt_limit"] = rcpt_limit
+	}
+	if domain.Name != name {
+		update["name"] = name
+	}
+	if len(update) == 0 {
+		http.Redirect(w, r, HomeURL(), http.StatusFound)
+		return
+	}
 	update["updated_at"] = time.Now()
 	update["updated_by"] = ctx.CurrentAddress.ID
+	old_name := domain.Name
 
-	if err := db.Model(domain).Updates(update).Error; err != nil {
+	tx := db.Begin()
+	if err := DomainSave(domain, update, ctx.CurrentAddress.ID, tx); err != nil {
+		tx.Rollback()
+		log.Printf("ERROR DomainUpdate:DomainSave: %s", err)
 		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
-		if strings.Index(err.Error(), "UNIQUE") >= 0 {
+		if DBIsUnique(err) {
 			flash = fmt.Sprintf(t("flash_error_exists"), name)
 		}
 		SetFlash(w, F_ERROR, flash)
 		http.Redirect(w, r, HomeURL(), http.StatusFound)
 		return
 	}
-
-	addresses := []Address{}
-	if err := db.Where("domain_id = ?", domain.ID).Find(&addresses).Error; err != nil {
+	if err := tx.Commit().Error; err != nil {
 		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
 		SetFlash(w, F_ERROR, flash)
 		http.Redirect(w, r, HomeURL(), http.StatusFound)
 		return
 	}
+
+	if old_name != domain.Name {
+		WebhookFire(&WebhookPayload{
+			Event:  WEBHOOK_DOMAIN_RENAMED,
+			Actor:  ctx.CurrentAddress.Email,
+			Domain: WebhookDomainOf(domain, old_name),
+		}, db)
+	} else {
+		WebhookFire(&WebhookPayload{
+			Event:  WEBHOOK_DOMAIN_UPDATED,
+			Actor:  ctx.CurrentAddress.Email,
+			Domain: WebhookDomainOf(domain, ""),
+		}, db)
+	}
+
+	// Every mailbox of a renamed domain moves along. That may take longer
+	// than the request, so the hooks run in the background and failures
+	// show up on the hooks page.
+	if old_name != domain.Name {
+		addresses := []Address{}
+		db.Where("domain_id = ?", domain.ID).Find(&addresses)
+		for index, _ := range addresses {
+			address := &addresses[index]
+			WebhookFire(&WebhookPayload{
+				Event:   WEBHOOK_ADDRESS_RENAMED,
+				Actor:   ctx.CurrentAddress.Email,
+				Address: WebhookAddressOf(address, fmt.Sprintf("%s@%s", address.LocalPart, old_name)),
+			}, db)
+		}
+		if len(addresses) > 0 && len(HookActions(HOOK_MOVE)) > 0 {
+			go func() {
+				for _, address := range addresses {
+					old_email := fmt.Sprintf("%s@%s", address.LocalPart, old_name)
+					HookFire(HOOK_MOVE, address.ID, address.Email, old_email)
+				}
+				log.Printf("INFO  Hook:%s: %d mailboxes of %s done", HOOK_MOVE, len(addresses), domain.Name)
+			}()
+			flash := fmt.Sprintf(t("hook_moving"), domain.Name)
+			SetFlash(w, F_INFO, flash)
+			http.Redirect(w, r, HookURL(), http.StatusFound)
+			return
+		}
+	}
+
+	flash := fmt.Sprintf(t("flash_updated"), domain.Name)
+	SetFlash(w, F_INFO, flash)
+	http.Redirect(w, r, HomeURL(), http.StatusFound)
+}
+
+// DomainSave applies update to domain and, if it is renamed, carries
+// the new name over to its addresses, aliases and relay recipients. It
+// is meant to run inside a transaction, so any error leaves nothing
+// half done.
+func DomainSave(domain *Domain, update map[string]interface{}, uid int, tx *gorm.DB) error {
+	t := DBTfunc(tx)
+
+	if err := tx.Model(domain).Updates(update).Error; err != nil {
+		return err
+	}
+	if err := DomainRelaySync(domain, tx); err != nil {
+		return err
+	}
+	if _, ok := update["name"]; !ok {
+		return nil
+	}
+
+	addresses := []Address{}
+	if err := tx.Where("domain_id = ?", domain.ID).Find(&addresses).Error; err != nil {
+		return err
+	}
 	for index, _ := range addresses {
 		address := &addresses[index]
-		db.Model(address).Updates(Address{
+		if err := tx.Model(address).Updates(Address{
 			Email:      fmt.Sprintf("%s@%s", address.LocalPart, domain.Name),
 			DomainName: domain.Name,
 			UpdatedAt:  time.Now(),
-			UpdatedBy:  ctx.CurrentAddress.ID,
-		})
+			UpdatedBy:  uid,
+		}).Error; err != nil {
+			return err
+		}
 	}
 
 	aliases := []Alias{}
-	if err := db.Where("domain_id = ?", domain.ID).Find(&aliases).Error; err != nil {
-		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
-		SetFlash(w, F_ERROR, flash)
-		http.Redirect(w, r, HomeURL(), http.StatusFound)
-		return
+	if err := tx.Where("domain_id = ?", domain.ID).Find(&aliases).Error; err != nil {
+		return err
 	}
 	for index, _ := range aliases {
 		alias := &aliases[index]
-		destination := AddressFindByID(alias.AddressID, db)
+		destination := AddressFindByID(alias.AddressID, tx)
 		if destination == nil {
-			flash := fmt.Sprintf(t("flash_address_not_found"), alias.AddressID)
-			SetFlash(w, F_ERROR, flash)
-			http.Redirect(w, r, HomeURL(), http.StatusFound)
-			return
+			return fmt.Errorf(t("flash_address_not_found"), alias.AddressID)
 		}
-		db.Model(alias).Updates(Alias{
+		if err := tx.Model(alias).Updates(Alias{
 			Email:       fmt.Sprintf("%s@%s", alias.LocalPart, domain.Name),
 			Destination: destination.Email,
 			DomainName:  domain.Name,
 			UpdatedAt:   time.Now(),
-			UpdatedBy:   ctx.CurrentAddress.ID,
-		})
+			UpdatedBy:   uid,
+		}).Error; err != nil {
+			return err
+		}
 	}
 
-	flash := fmt.Sprintf(t("flash_updated"), domain.Name)
-	SetFlash(w, F_INFO, flash)
-	http.Redirect(w, r, HomeURL(), http.StatusFound)
+	return nil
 }
 
 func DomainDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 	id, _ := strconv.Atoi(ps.ByName("id"))
 	log.Printf("INFO  GET %sdomain/%d/delete", Base_URL, id)
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	ctx := AddressContext(w, r, "domain_delete", true, db)
 	if !ctx.LoggedIn {
@@ -280,20 +574,40 @@ func DomainDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	}
 	name := domain.Name
 
-	domain.DomainSetup(db)
-	if len(domain.Addresses) > 0 {
+	count := 0
+	db.Model(&Address{}).Where("domain_id = ?", domain.ID).Count(&count)
+	if count > 0 {
 		flash := fmt.Sprintf(t("flash_domain_not_empty"), name)
 		SetFlash(w, F_ERROR, flash)
 		http.Redirect(w, r, HomeURL(), http.StatusFound)
 		return
 	}
 
-	if err := db.Delete(domain).Error; err != nil {
+	payload := &WebhookPayload{
+		Event:  WEBHOOK_DOMAIN_DELETED,
+		Actor:  ctx.CurrentAddress.Email,
+		Domain: WebhookDomainOf(domain, ""),
+	}
+	tx := db.Begin()
+	err := tx.Where("domain_id = ?", domain.ID).Delete(&RelayRecipient{}).Error
+	if err == nil {
+		err = tx.Where("domain_id = ?", domain.ID).Delete(&Notice{}).Error
+	}
+	if err == nil {
+		err = tx.Delete(domain).Error
+	}
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
 		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
 		SetFlash(w, F_ERROR, flash)
 		http.Redirect(w, r, HomeURL(), http.StatusFound)
 		return
 	}
+	WebhookFire(payload, db)
 
 	flash := fmt.Sprintf(t("flash_deleted"), name)
 	SetFlash(w, F_INFO, flash)
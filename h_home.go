@@ -2,21 +2,35 @@ package main
 
 import (
 	"log"
+	"bytes"
+	"strings"
+	"strconv"
 	"net/http"
+	"encoding/json"
 	"github.com/julienschmidt/httprouter"
-	"github.com/nicksnyder/go-i18n/i18n"
 )
 
+type HomeCell struct {
+	Address       *Address
+	MyID          int
+}
+
+var HomeColumns = []string{"domain_name", "email"}
+
 func HomeURL() string {
 	return Base_URL
 }
 
+func HomeAddressesURL() string {
+	return Base_URL + "addresses"
+}
+
 func HomeIndex(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 	log.Printf("INFO  GET %s", HomeURL())
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	ctx := AddressContext(w, r, "home_title", false, db)
 	if !ctx.LoggedIn {
@@ -29,28 +43,86 @@ func HomeIndex(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		return
 	}
 
+	// The addresses are fetched page by page via HomeAddresses
+	ctx.Domains = DomainFindEmpty(db)
+
+	RenderHtml(w, r, "home", ctx)
+}
+
+// HomeAddresses serves the address table for DataTables
+// in server-side processing mode.
+func HomeAddresses(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Printf("INFO  GET %s", HomeAddressesURL())
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "home_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	draw, _ := strconv.Atoi(r.FormValue("draw"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+	length, _ := strconv.Atoi(r.FormValue("length"))
+	if length <= 0 || length > 1000 {
+		length = 100
+	}
+	search := strings.ToLower(strings.TrimSpace(r.FormValue("search[value]")))
+
+	order := HomeColumns[0]
+	if column, err := strconv.Atoi(r.FormValue("order[0][column]")); err == nil && column >= 0 && column < len(HomeColumns) {
+		order = HomeColumns[column]
+	}
+	if r.FormValue("order[0][dir]") == "desc" {
+		order += " DESC"
+	}
+
+	total := 0
+	db.Model(&Address{}).Count(&total)
+
+	query := db.Model(&Address{})
+	if search != "" {
+		like := "%" + search + "%"
+		query = query.Where("LOWER(email) LIKE ? OR id IN (?)", like,
+			db.Table("aliases").Select("address_id").Where("LOWER(email) LIKE ?", like).QueryExpr())
+	}
+
+	filtered := 0
+	query.Count(&filtered)
+
 	addresses := []Address{}
-	if err := db.Find(&addresses).Error; err != nil {
-		log.Printf("ERROR HomeIndex:Addresses: %s", err)
-	} else {
-		for index, _ := range addresses {
-			address := &addresses[index]
-			address.AddressSetup(db)
-		}
+	if err := AddressPreload(query).Order(order).Order("email").Offset(start).Limit(length).Find(&addresses).Error; err != nil {
+		log.Printf("ERROR HomeAddresses: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	ctx.Addresses = addresses
 
-	domains := []Domain{}
-	if err := db.Find(&domains).Error; err != nil {
-		log.Printf("ERROR HomeIndex:Domains: %s", err)
-	} else {
-		for _, domain := range domains {
-			domain.DomainSetup(db)
-			if len(domain.Addresses) == 0 {
-				ctx.Domains = append(ctx.Domains, domain)
+	data := [][]string{}
+	for index, _ := range addresses {
+		address := &addresses[index]
+		address.AddressDecorate(db)
+
+		cell := HomeCell{Address: address, MyID: ctx.CurrentAddress.ID}
+		row := []string{}
+		for _, tmpl := range []string{"home_cell_domain", "home_cell_address", "home_cell_aliases", "home_cell_action"} {
+			buf := bytes.Buffer{}
+			if err := LanguageTemplates(RequestLanguage(r)).ExecuteTemplate(&buf, tmpl, cell); err != nil {
+				log.Printf("ERROR HomeAddresses:%s: %s", tmpl, err)
 			}
+			row = append(row, buf.String())
 		}
+		data = append(data, row)
 	}
 
-	RenderHtml(w, r, "home", ctx)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"draw":            draw,
+		"recordsTotal":    total,
+		"recordsFiltered": filtered,
+		"data":            data,
+	})
+	if err != nil {
+		log.Printf("ERROR HomeAddresses:Encode: %s", err)
+	}
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"fmt"
+	"strconv"
+	"net/http"
+	"github.com/julienschmidt/httprouter"
+)
+
+func HookURL() string {
+	return Base_URL + "hooks"
+}
+
+// HookShow lists the failed hook actions, latest first.
+func HookShow(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Printf("INFO  GET %s", HookURL())
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "hook_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	if err := db.Order("updated_at DESC").Find(&ctx.HookFailures).Error; err != nil {
+		log.Printf("ERROR HookShow: %s", err)
+	}
+
+	RenderHtml(w, r, "hooks", ctx)
+}
+
+func HookRetryPost(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t := RequestTfunc(r)
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	log.Printf("INFO  POST %shooks/%d/retry", Base_URL, id)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "hook_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	failure := &HookFailure{}
+	if err := db.First(failure, id).Error; err != nil {
+		flash := fmt.Sprintf(t("flash_hook_not_found"), id)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HookURL(), http.StatusFound)
+		return
+	}
+
+	if err := HookRetry(failure); err != nil {
+		flash := fmt.Sprintf(t("flash_hook_failed"), failure.Email, err.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HookURL(), http.StatusFound)
+		return
+	}
+
+	flash := fmt.Sprintf(t("hook_retried"), failure.Email)
+	SetFlash(w, F_INFO, flash)
+	http.Redirect(w, r, HookURL(), http.StatusFound)
+}
+
+// HookDelete drops a failure, e.g. after fixing things by hand.
+func HookDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t := RequestTfunc(r)
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	log.Printf("INFO  GET %shooks/%d/delete", Base_URL, id)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "hook_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	result := db.Where("id = ?", id).Delete(&HookFailure{})
+	if result.Error != nil {
+		flash := fmt.Sprintf(t("flash_error_text"), result.Error.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HookURL(), http.StatusFound)
+		return
+	}
+	if result.RowsAffected == 0 {
+		flash := fmt.Sprintf(t("flash_hook_not_found"), id)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HookURL(), http.StatusFound)
+		return
+	}
+
+	flash := fmt.Sprintf(t("flash_deleted"), fmt.Sprintf("#%d", id))
+	SetFlash(w, F_INFO, flash)
+	http.Redirect(w, r, HookURL(), http.StatusFound)
+}
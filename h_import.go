@@ -0,0 +1,320 @@
+package main
+
+import (
+	"io"
+	"log"
+	"fmt"
+	"time"
+	"bytes"
+	"regexp"
+	"strings"
+	"strconv"
+	"net/http"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/jinzhu/gorm"
+)
+
+type ImportRow struct {
+	Line          int         `json:"-"`
+	DomainName    string      `json:"domain"`
+	LocalPart     string      `json:"local_part"`
+	OtherEmail    string      `json:"other_email"`
+	Admin         bool        `json:"admin"`
+	Aliases       []string    `json:"aliases"`
+	Errors        []string    `json:"-"`
+}
+
+var (
+	ImportColumns   = []string{"domain", "local_part", "other_email", "admin", "aliases"}
+	// Not starting with a dot, the local part names the maildir
+	ImportLocalPart = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9\._-]{1,39}$`)
+)
+
+func ImportURL() string {
+	return Base_URL + "import"
+}
+
+func ExportURL() string {
+	return Base_URL + "export"
+}
+
+func ImportParse(data, format string) ([]ImportRow, error) {
+	rows := []ImportRow{}
+
+	if format == "json" {
+		if err := json.Unmarshal([]byte(data), &rows); err != nil {
+			return nil, err
+		}
+		for index, _ := range rows {
+			rows[index].Line = index + 1
+		}
+		return rows, nil
+	}
+
+	reader := csv.NewReader(strings.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for index, record := range records {
+		if index == 0 && len(record) > 0 && record[0] == ImportColumns[0] {
+			continue	// header line
+		}
+		for len(record) < len(ImportColumns) {
+			record = append(record, "")
+		}
+		admin, _ := strconv.ParseBool(record[3])
+		rows = append(rows, ImportRow{
+			Line:       index + 1,
+			DomainName: strings.TrimSpace(record[0]),
+			LocalPart:  strings.TrimSpace(record[1]),
+			OtherEmail: strings.TrimSpace(record[2]),
+			Admin:      admin,
+			Aliases:    strings.Fields(record[4]),
+		})
+	}
+
+	return rows, nil
+}
+
+// ImportCheck validates every row with the same rules as the address
+// form, and returns the number of rows with errors.
+func ImportCheck(rows []ImportRow, db *gorm.DB) int {
+	t := DBTfunc(db)
+
+	seen := make(map[string]int)
+	failed := 0
+
+	for index, _ := range rows {
+		row := &rows[index]
+		row.Errors = []string{}
+
+		check := func(local_part string) {
+			email := fmt.Sprintf("%s@%s", local_part, row.DomainName)
+			if !ImportLocalPart.MatchString(local_part) {
+				row.Errors = append(row.Errors, fmt.Sprintf(t("import_bad_local_part"), local_part))
+				return
+			}
+			if line, ok := seen[email]; ok {
+				row.Errors = append(row.Errors, fmt.Sprintf(t("import_duplicate"), email, line))
+				return
+			}
+			seen[email] = row.Line
+			if address := AddressFindByEmail(email, db); address != nil {
+				row.Errors = append(row.Errors, fmt.Sprintf(t("flash_error_exists"), email))
+				return
+			}
+			if flash := AliasCheck(local_part, row.DomainName, 0, db); flash != "" {
+				row.Errors = append(row.Errors, flash)
+			}
+		}
+
+		if domain := DomainFindByName(row.DomainName, db); domain == nil {
+			row.Errors = append(row.Errors, fmt.Sprintf(t("import_unknown_domain"), row.DomainName))
+		} else if !domain.IsMailbox() {
+			row.Errors = append(row.Errors, fmt.Sprintf(t("flash_domain_no_mailbox"), row.DomainName))
+		} else {
+			check(row.LocalPart)
+			for _, alias := range row.Aliases {
+				if alias != row.LocalPart {
+					check(alias)
+				}
+			}
+		}
+
+		if len(row.Errors) > 0 {
+			failed++
+		}
+	}
+
+	return failed
+}
+
+func ImportApply(rows []ImportRow, current *Address, db *gorm.DB) error {
+	tx := db.Begin()
+
+	for _, row := range rows {
+		domain := DomainFindByName(row.DomainName, tx)
+		if domain == nil {
+			tx.Rollback()
+			return fmt.Errorf("line %d: unknown domain %s", row.Line, row.DomainName)
+		}
+
+		address := &Address{
+			LocalPart:  row.LocalPart,
+			DomainName: domain.Name,
+			Email:      fmt.Sprintf("%s@%s", row.LocalPart, domain.Name),
+			OtherEmail: row.OtherEmail,
+			DomainID:   domain.ID,
+			Admin:      row.Admin,
+			CreatedBy:  current.ID,
+			UpdatedBy:  current.ID,
+		}
+		if err := tx.Create(address).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("line %d: %s", row.Line, err)
+		}
+
+		for _, alias := range row.Aliases {
+			if alias == row.LocalPart {
+				continue
+			}
+			if flash := AliasCreate(address, alias, tx); flash != "" {
+				tx.Rollback()
+				return fmt.Errorf("line %d: %s", row.Line, flash)
+			}
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+func ImportForm(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Printf("INFO  GET %s", ImportURL())
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "import_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+	ctx.ImportFormat = "csv"
+
+	RenderHtml(w, r, "import", ctx)
+}
+
+func ImportPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	t := RequestTfunc(r)
+	log.Printf("INFO  POST %s", ImportURL())
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "import_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	format := r.FormValue("import_format")
+	action := r.FormValue("import_action")
+	data := r.FormValue("import_data")
+	if file, _, err := r.FormFile("import_file"); err == nil {
+		buf := bytes.Buffer{}
+		io.Copy(&buf, file)
+		file.Close()
+		data = buf.String()
+	}
+	if format != "json" {
+		format = "csv"
+	}
+
+	rows, err := ImportParse(data, format)
+	if err != nil {
+		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, ImportURL(), http.StatusFound)
+		return
+	}
+	failed := ImportCheck(rows, db)
+
+	if action == "apply" && failed == 0 {
+		if err := ImportApply(rows, ctx.CurrentAddress, db); err != nil {
+			flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+			SetFlash(w, F_ERROR, flash)
+			http.Redirect(w, r, ImportURL(), http.StatusFound)
+			return
+		}
+
+		flash := fmt.Sprintf(t("import_done", len(rows)), len(rows))
+		SetFlash(w, F_INFO, flash)
+		http.Redirect(w, r, HomeURL(), http.StatusFound)
+		return
+	}
+
+	ctx.ImportRows = rows
+	ctx.ImportData = data
+	ctx.ImportFormat = format
+	ctx.ImportOK = (failed == 0 && len(rows) > 0)
+
+	RenderHtml(w, r, "import", ctx)
+}
+
+func Export(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Printf("INFO  GET %s", ExportURL())
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "export_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	query := db.Order("domain_name").Order("local_part")
+	filename := "postfix-go"
+	if domain_id, _ := strconv.Atoi(r.FormValue("domain")); domain_id != 0 {
+		if domain := DomainFindByID(domain_id, db); domain != nil {
+			query = query.Where("domain_id = ?", domain.ID)
+			filename = domain.Name
+		}
+	}
+
+	addresses := []Address{}
+	if err := AddressPreload(query).Find(&addresses).Error; err != nil {
+		log.Printf("ERROR Export:Addresses: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows := []ImportRow{}
+	for index, _ := range addresses {
+		address := &addresses[index]
+		row := ImportRow{
+			DomainName: address.DomainName,
+			LocalPart:  address.LocalPart,
+			OtherEmail: address.OtherEmail,
+			Admin:      address.Admin,
+			Aliases:    []string{},
+		}
+		for _, alias := range address.Aliases {
+			row.Aliases = append(row.Aliases, alias.LocalPart)
+		}
+		rows = append(rows, row)
+	}
+
+	filename += time.Now().Format("-20060102")
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.json\"", filename))
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rows); err != nil {
+			log.Printf("ERROR Export:Encode: %s", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.csv\"", filename))
+	writer := csv.NewWriter(w)
+	writer.Write(ImportColumns)
+	for _, row := range rows {
+		writer.Write([]string{
+			row.DomainName,
+			row.LocalPart,
+			row.OtherEmail,
+			strconv.FormatBool(row.Admin),
+			strings.Join(row.Aliases, " "),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("ERROR Export:Write: %s", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"log"
+	"fmt"
+	"time"
+	"strings"
+	"net/url"
+	"net/http"
+	"path/filepath"
+	"html/template"
+	"github.com/julienschmidt/httprouter"
+	"github.com/jinzhu/gorm"
+	"github.com/nicksnyder/go-i18n/i18n"
+)
+
+type LanguageOption struct {
+	Tag           string
+	Name          string
+}
+
+var (
+	Languages     []LanguageOption
+	Templates_Lang = make(map[string]*template.Template)
+)
+
+// LanguageInit loads all locales/*.all.json files. The configured
+// Language must be one of them, it is the fallback for missing keys.
+func LanguageInit() error {
+	files, err := filepath.Glob("locales/*.all.json")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := i18n.LoadTranslationFile(file); err != nil {
+			return err
+		}
+	}
+
+	found := false
+	for _, tag := range i18n.LanguageTags() {
+		t, _ := i18n.Tfunc(tag)
+		Languages = append(Languages, LanguageOption{Tag: tag, Name: t("lang_name")})
+		found = found || tag == Language
+	}
+	if !found {
+		return fmt.Errorf("locales/%s.all.json not found", Language)
+	}
+
+	return nil
+}
+
+// LanguageTemplatesInit parses the templates once per language,
+// so T and time don't need to know about the request.
+func LanguageTemplatesInit() {
+	for _, lang := range Languages {
+		Templates_Lang[lang.Tag] = template.Must(template.New("").Funcs(LanguageFuncs(lang.Tag)).ParseGlob("templates/*"))
+	}
+	Templates = Templates_Lang[Language]
+}
+
+func LanguageTemplates(lang string) *template.Template {
+	if tmpl, ok := Templates_Lang[lang]; ok {
+		return tmpl
+	}
+	return Templates
+}
+
+func LanguageFuncs(lang string) template.FuncMap {
+	t := LanguageTfunc(lang)
+
+	return template.FuncMap{
+		"safe": func(s string) template.HTML {
+			return template.HTML(s)
+		},
+		"T": func(s string, args ...interface{}) string {
+			return t(s, args...)
+		},
+		"time": func(tm time.Time) string {
+			return tm.Format(t("date_time"))
+		},
+	}
+}
+
+// LanguageTfunc translates into lang, falling back
+// to the default Language for missing keys.
+func LanguageTfunc(lang string) i18n.TranslateFunc {
+	t, _ := i18n.Tfunc(lang, Language)
+	fallback, _ := i18n.Tfunc(Language)
+
+	return func(id string, args ...interface{}) string {
+		if text := t(id, args...); text != id {
+			return text
+		}
+		return fallback(id, args...)
+	}
+}
+
+// LanguageMatch returns the supported language for a tag or
+// an Accept-Language header, or "" if there is none.
+func LanguageMatch(source string) string {
+	for _, tag := range i18n.LanguageTags() {
+		if strings.EqualFold(source, tag) {
+			return tag
+		}
+	}
+	for _, part := range strings.Split(source, ",") {
+		tag := strings.ToLower(strings.TrimSpace(strings.SplitN(part, ";", 2)[0]))
+		tag = strings.SplitN(tag, "-", 2)[0]
+		for _, lang := range Languages {
+			if lang.Tag == tag {
+				return tag
+			}
+		}
+	}
+	return ""
+}
+
+// RequestLanguage picks the language for r: the one chosen with the
+// switcher (or stored with the address at login), then the browser
+// preference, then the default.
+func RequestLanguage(r *http.Request) string {
+	if r == nil {
+		return Language
+	}
+	if lang := LanguageMatch(GetCookie(r, "language")); lang != "" {
+		return lang
+	}
+	if lang := LanguageMatch(r.Header.Get("Accept-Language")); lang != "" {
+		return lang
+	}
+	return Language
+}
+
+func RequestTfunc(r *http.Request) i18n.TranslateFunc {
+	return LanguageTfunc(RequestLanguage(r))
+}
+
+// DBTfunc translates into the language of the request
+// the database handle was opened for.
+func DBTfunc(db *gorm.DB) i18n.TranslateFunc {
+	if lang, ok := db.Get("language"); ok {
+		return LanguageTfunc(lang.(string))
+	}
+	return LanguageTfunc(Language)
+}
+
+// AddressTfunc translates into the language of address,
+// for mails and letters sent to its owner.
+func AddressTfunc(address *Address) i18n.TranslateFunc {
+	return LanguageTfunc(AddressLanguage(address))
+}
+
+func AddressLanguage(address *Address) string {
+	if lang := LanguageMatch(address.Language); lang != "" {
+		return lang
+	}
+	return Language
+}
+
+func LanguageSwitch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	lang := LanguageMatch(ps.ByName("lang"))
+	log.Printf("INFO  GET %slanguage/%s", Base_URL, lang)
+
+	if lang != "" {
+		SetCookie(w, "language", lang)
+
+		db := OpenDB(r, true)
+		defer CloseDB(db)
+
+		if address, ok := AddressIsLoggedIn(r, db); ok && address.Language != lang {
+			if err := db.Model(address).UpdateColumn("language", lang).Error; err != nil {
+				log.Printf("ERROR LanguageSwitch: %s", err)
+			}
+		}
+	}
+
+	http.Redirect(w, r, LanguageBackURL(r), http.StatusFound)
+}
+
+// LanguageBackURL returns to the page the language was switched on,
+// but only to one of ours.
+func LanguageBackURL(r *http.Request) string {
+	referer, err := url.Parse(r.Referer())
+	if err != nil || referer.Host != r.Host || !strings.HasPrefix(referer.Path, Base_URL) {
+		return HomeURL()
+	}
+	if referer.Scheme != "http" && referer.Scheme != "https" {
+		return HomeURL()
+	}
+	// "//host" would be taken as another site by the browser
+	if strings.HasPrefix(referer.Path, "//") || strings.Contains(referer.Path, "\\") {
+		return HomeURL()
+	}
+	return referer.RequestURI()
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"os"
+	"log"
+	"fmt"
+	"time"
+	"bytes"
+	"strconv"
+	"strings"
+	"net/http"
+	"path/filepath"
+	"github.com/julienschmidt/httprouter"
+	"github.com/jinzhu/gorm"
+	"github.com/jung-kurt/gofpdf"
+	"github.com/skip2/go-qrcode"
+	"github.com/nicksnyder/go-i18n/i18n"
+)
+
+// LetterNew starts an empty A4 document, one page is
+// added per address with LetterPage.
+func LetterNew(title string) *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle(title, true)
+	pdf.SetMargins(20, 15, 20)
+	pdf.SetAutoPageBreak(true, 15)
+	return pdf
+}
+
+// LetterPage adds the letter for address with its new interim password.
+// Heading and text are the notice letter in the language of the
+// recipient, logo and sender block come from the configuration.
+func LetterPage(pdf *gofpdf.Fpdf, address *Address, initial string, db *gorm.DB) error {
+	t := AddressTfunc(address)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	notice := NoticeFind(NOTICE_LETTER, AddressLanguage(address), address.DomainID, db)
+	if notice == nil {
+		return fmt.Errorf("no template for notice %s", NOTICE_LETTER)
+	}
+	data := NoticeDataNew(address, db)
+	data.Initial = initial
+	rendered, err := NoticeRender(notice, notice.Language, data)
+	if err != nil {
+		return fmt.Errorf("notice %s: %s", NOTICE_LETTER, err)
+	}
+
+	pdf.AddPage()
+
+	if Letter_Logo != "" {
+		if _, err := os.Stat(Letter_Logo); err == nil {
+			pdf.ImageOptions(Letter_Logo, 150, 12, 40, 0, false, gofpdf.ImageOptions{ReadDpi: true}, 0, "")
+		} else {
+			log.Printf("ERROR LetterPage:Logo: %s", err)
+		}
+	}
+
+	// Sender in one small line above the recipient, as in a window envelope
+	sender := Letter_Sender
+	if len(sender) == 0 {
+		sender = []string{"postmaster@" + Def_Domain}
+	}
+	pdf.SetXY(20, 45)
+	pdf.SetFont("arial", "U", 7)
+	pdf.CellFormat(85, 4, tr(strings.Join(sender, " - ")), "", 1, "L", false, 0, "")
+
+	pdf.SetFont("arial", "", 11)
+	pdf.SetX(20)
+	pdf.MultiCell(85, 5, tr(address.Email), "", "L", false)
+
+	pdf.SetXY(20, 80)
+	pdf.CellFormat(0, 5, time.Now().Format(t("letter_date")), "", 1, "R", false, 0, "")
+
+	pdf.SetY(95)
+	pdf.SetFont("arial", "B", 13)
+	pdf.MultiCell(0, 7, tr(rendered.Subject), "", "L", false)
+	pdf.Ln(4)
+
+	pdf.SetFont("arial", "", 11)
+	pdf.MultiCell(0, 5, tr(strings.TrimSpace(rendered.Text)), "", "L", false)
+	pdf.Ln(6)
+
+	pdf.SetFont("arial", "", 11)
+	pdf.CellFormat(60, 10, tr(t("password_email_initial")), "1", 0, "L", false, 0, "")
+	pdf.SetFont("courier", "B", 14)
+	pdf.CellFormat(0, 10, initial, "1", 1, "C", false, 0, "")
+	pdf.Ln(2)
+	pdf.SetFont("arial", "", 11)
+	pdf.MultiCell(0, 5, tr(t("password_email_info")), "", "L", false)
+
+	if Letter_QR {
+		if err := LetterQR(pdf, t, data.Settings); err != nil {
+			log.Printf("ERROR LetterPage:QR: %s", err)
+		}
+	}
+
+	return pdf.Error()
+}
+
+// LetterQR prints the IMAP and SMTP settings as QR code, as plain
+// text since mail clients don't agree on an account URL format.
+func LetterQR(pdf *gofpdf.Fpdf, t i18n.TranslateFunc, settings MailSettings) error {
+	text := fmt.Sprintf("IMAP: %s:%d %s\nSMTP: %s:%d %s\n%s: %s",
+		settings.ImapHost, settings.ImapPort, settings.ImapSecurity,
+		settings.SubmitHost, settings.SubmitPort, settings.SubmitSecurity,
+		t("letter_username"), settings.Email)
+
+	png, err := qrcode.Encode(text, qrcode.Medium, 256)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("qr_%s", settings.Email)
+	pdf.RegisterImageOptionsReader(name, gofpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(png))
+
+	y := pdf.GetY() + 8
+	if y + 40 > 282 {
+		pdf.AddPage()
+		y = pdf.GetY()
+	}
+	pdf.ImageOptions(name, 20, y, 35, 35, false, gofpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetFont("arial", "", 9)
+	pdf.SetXY(60, y + 12)
+	pdf.MultiCell(0, 5, tr(t("letter_qr_hint")), "", "L", false)
+
+	return nil
+}
+
+// LetterOutput sends the document, inline so that it opens in the browser.
+func LetterHeader(w http.ResponseWriter, filename string) {
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filepath.Base(filename)))
+}
+
+func LetterOutput(w http.ResponseWriter, pdf *gofpdf.Fpdf, filename string) {
+	LetterHeader(w, filename)
+	if err := pdf.Output(w); err != nil {
+		log.Printf("ERROR LetterOutput: %s", err)
+	}
+}
+
+func DomainLetters(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t := RequestTfunc(r)
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	log.Printf("INFO  GET %sdomain/%d/letters", Base_URL, id)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "letter_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	if ctx.Domain = DomainFindByID(id, db); ctx.Domain == nil {
+		flash := fmt.Sprintf(t("flash_domain_not_found"), id)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HomeURL(), http.StatusFound)
+		return
+	}
+	ctx.Domain.DomainSetup(db)
+
+	RenderHtml(w, r, "domain_letters", ctx)
+}
+
+// DomainLettersPost resets the interim passwords of the selected
+// addresses (all if none is selected) and returns one merged PDF.
+func DomainLettersPost(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t := RequestTfunc(r)
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	log.Printf("INFO  POST %sdomain/%d/letters", Base_URL, id)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "letter_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	domain := DomainFindByID(id, db)
+	if domain == nil {
+		flash := fmt.Sprintf(t("flash_domain_not_found"), id)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HomeURL(), http.StatusFound)
+		return
+	}
+	back := fmt.Sprintf("%sdomain/%d/letters", Base_URL, domain.ID)
+
+	r.ParseForm()
+	query := db.Where("domain_id = ?", domain.ID)
+	if selected := r.Form["letter_address"]; len(selected) > 0 {
+		query = query.Where("id IN (?)", selected)
+	}
+	addresses := []Address{}
+	if err := query.Order("local_part").Find(&addresses).Error; err != nil {
+		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, back, http.StatusFound)
+		return
+	}
+	if len(addresses) == 0 {
+		SetFlash(w, F_ERROR, t("letter_none"))
+		http.Redirect(w, r, back, http.StatusFound)
+		return
+	}
+
+	// Every password costs a bcrypt round, so the batch is limited to
+	// what can be built within the write timeout of the server.
+	if Letter_Batch > 0 && len(addresses) > Letter_Batch {
+		flash := fmt.Sprintf(t("letter_too_many"), Letter_Batch)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, back, http.StatusFound)
+		return
+	}
+
+	// Nothing is changed unless all letters could be built and written
+	// out. The pages are built without the request limit of DB_Timeout
+	// and before the (short) transaction.
+	bg := OpenDB(nil, true)
+	defer CloseDB(bg)
+
+	pdf := LetterNew(fmt.Sprintf("%s: %s", t("letter_title"), domain.Name))
+	hashes := make([]string, len(addresses))
+	for index, _ := range addresses {
+		address := &addresses[index]
+		initial := PasswordRandom(10)
+		hashes[index] = PasswordBcrypt(address.Email, initial)
+		if err := LetterPage(pdf, address, initial, bg); err != nil {
+			log.Printf("ERROR DomainLettersPost: %s: %s", address.Email, err)
+			flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+			SetFlash(w, F_ERROR, flash)
+			http.Redirect(w, r, back, http.StatusFound)
+			return
+		}
+	}
+	buffer := &bytes.Buffer{}
+	if err := pdf.Output(buffer); err != nil {
+		log.Printf("ERROR DomainLettersPost: %s", err)
+		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, back, http.StatusFound)
+		return
+	}
+
+	tx := bg.Begin()
+	for index, _ := range addresses {
+		if err := AddressInitialSave(&addresses[index], hashes[index], ctx.CurrentAddress.ID, tx); err != nil {
+			tx.Rollback()
+			log.Printf("ERROR DomainLettersPost: %s: %s", addresses[index].Email, err)
+			flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+			SetFlash(w, F_ERROR, flash)
+			http.Redirect(w, r, back, http.StatusFound)
+			return
+		}
+	}
+
+	// The passwords only become valid once the client has the letters
+	LetterHeader(w, fmt.Sprintf("letters-%s.pdf", domain.Name))
+	if _, err := buffer.WriteTo(w); err != nil {
+		tx.Rollback()
+		log.Printf("ERROR DomainLettersPost: %s: %s", domain.Name, err)
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("ERROR DomainLettersPost: %s: letters sent, but passwords not saved: %s", domain.Name, err)
+		return
+	}
+	log.Printf("INFO  Letters: %d for %s", len(addresses), domain.Name)
+}
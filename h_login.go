@@ -3,14 +3,10 @@ package main
 import (
 	"log"
 	"fmt"
-	"io"
-	"time"
 	"net/http"
 	"golang.org/x/crypto/bcrypt"
 	"github.com/julienschmidt/httprouter"
 	"github.com/jinzhu/gorm"
-	"github.com/nicksnyder/go-i18n/i18n"
-	"gopkg.in/gomail.v2"
 )
 
 func LoginURL() string {
@@ -22,35 +18,19 @@ func LogoutURL() string {
 }
 
 func LoginEmail(address *Address, db *gorm.DB) error {
-	t, _ := i18n.Tfunc(Language)
-
-	initial := PasswordRandom(10)
-	update := make(map[string]interface{})
-	update["initial"] = PasswordBcrypt(address.Email, initial)
-	update["updated_at"] = time.Now()
-	update["updated_by"] = address.ID
-
-	if err := db.Model(address).Updates(update).Error; err != nil {
-		log.Printf("ERROR LoginEmail:Updates: %s", err)
+	initial, err := AddressInitial(address, address.ID, db)
+	if err != nil {
+		log.Printf("ERROR LoginEmail:AddressInitial: %s", err)
 		return err
 	}
 
-	mail := gomail.NewMessage()
-	mail.SetHeader("From",    address.Email)
-	mail.SetHeader("To",      address.OtherEmail)
-	mail.SetHeader("Subject", fmt.Sprintf(t("address_email_subject"), address.Email))
-	address.Initial = initial
-
-	tmpl := fmt.Sprintf("password_email_%s", Language)
-	mail.AddAlternativeWriter("text/plain", func(w io.Writer) error {
-		return Templates.ExecuteTemplate(w, tmpl, address)
-	})
-
-	dial := gomail.NewDialer(SMTP_Host, SMTP_Port, SMTP_Username, SMTP_Password)
-	if err := dial.DialAndSend(mail); err != nil {
-		log.Printf("ERROR LoginEmail:DialAndSend: %s", err)
+	data := NoticeDataNew(address, db)
+	data.Initial = initial
+	if err := NoticeSend(NOTICE_RESET, address, []string{address.OtherEmail}, data, db); err != nil {
+		log.Printf("ERROR LoginEmail:NoticeSend: %s", err)
 		return err
 	}
+	MetricsReset()
 
 	return nil
 }
@@ -64,11 +44,11 @@ func LoginLoginGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 }
 
 func LoginLoginPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 	log.Printf("INFO  POST %s", LoginURL())
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	email    := r.FormValue("login_email")
 	password := r.FormValue("login_password")
@@ -78,6 +58,7 @@ func LoginLoginPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	address := AddressFindByEmail(email, db)
 	if address == nil {
 		log.Printf("DEBUG Login: address %s unknown", email)
+		MetricsLogin("failure")
 		SetFlash(w, F_ERROR, t("flash_login_failure"))
 		http.Redirect(w, r, LoginURL(), http.StatusFound)
 		return
@@ -107,8 +88,15 @@ func LoginLoginPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	err_p := bcrypt.CompareHashAndPassword([]byte(address.Bcrypt),  []byte(password))
 	log.Printf("DEBUG Login: Password=%v", err_p)
 
+	// The stored preference wins over the browser from now on
+	if lang := LanguageMatch(address.Language); lang != "" && (err_i == nil || err_p == nil) {
+		SetCookie(w, "language", lang)
+		t = LanguageTfunc(lang)
+	}
+
 	if err_i == nil || (err_p == nil && address.Admin == false) {
 		log.Printf("DEBUG Login: send to PasswordURL")
+		MetricsLogin("success")
 		uid := fmt.Sprintf("%d", address.ID)
 		SetCookie(w, "address_id",  uid)
 		SetFlash(w, F_INFO, t("flash_login_update"))
@@ -118,6 +106,7 @@ func LoginLoginPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 
 	if err_p == nil && address.Admin == true {
 		log.Printf("DEBUG Login: send to HomeURL")
+		MetricsLogin("success")
 		uid := fmt.Sprintf("%d", address.ID)
 		SetCookie(w, "address_id",  uid)
 		SetFlash(w, F_INFO, t("flash_login_success"))
@@ -126,12 +115,13 @@ func LoginLoginPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	}
 
 	log.Printf("DEBUG Login: bad password for %s", address.Email)
+	MetricsLogin("failure")
 	SetFlash(w, F_ERROR, t("flash_login_failure"))
 	http.Redirect(w, r, LoginURL(), http.StatusFound)
 }
 
 func LoginLogout(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 	log.Printf("INFO  GET %s", LogoutURL())
 
 	uid := GetCookie(r, "address_id")
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"fmt"
+	"time"
+	"strconv"
+	"net/http"
+	"github.com/julienschmidt/httprouter"
+)
+
+func MailURL() string {
+	return Base_URL + "outbox"
+}
+
+// MailShow lists the messages not sent yet, failed ones first.
+func MailShow(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Printf("INFO  GET %s", MailURL())
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "mail_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	queued := []QueuedMail{}
+	if err := db.Select("id, created_at, updated_at, sender, recipients, subject, status, attempts, next_attempt, last_error").
+		Order("status = '" + MAIL_FAILED + "' DESC").Order("id").Find(&queued).Error; err != nil {
+		log.Printf("ERROR MailShow: %s", err)
+	}
+	ctx.MailQueue = queued
+	if Mail_Sender != nil {
+		ctx.MailTransport = Mail_Sender.Name()
+	}
+
+	RenderHtml(w, r, "mail_queue", ctx)
+}
+
+// MailRetry sends a message again right away, with a fresh
+// number of attempts if it had failed for good.
+func MailRetry(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t := RequestTfunc(r)
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	log.Printf("INFO  POST %soutbox/%d/retry", Base_URL, id)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "mail_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	update := make(map[string]interface{})
+	update["status"] = MAIL_PENDING
+	update["attempts"] = 0
+	update["next_attempt"] = time.Now()
+	result := db.Model(&QueuedMail{}).Where("id = ? AND status <> ?", id, MAIL_SENDING).Updates(update)
+	if result.Error != nil {
+		flash := fmt.Sprintf(t("flash_error_text"), result.Error.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, MailURL(), http.StatusFound)
+		return
+	}
+	if result.RowsAffected == 0 {
+		flash := fmt.Sprintf(t("flash_mail_not_found"), id)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, MailURL(), http.StatusFound)
+		return
+	}
+	MailWake()
+
+	SetFlash(w, F_INFO, t("mail_retried"))
+	http.Redirect(w, r, MailURL(), http.StatusFound)
+}
+
+func MailDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t := RequestTfunc(r)
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	log.Printf("INFO  GET %soutbox/%d/delete", Base_URL, id)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "mail_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	result := db.Where("id = ? AND status <> ?", id, MAIL_SENDING).Delete(&QueuedMail{})
+	if result.Error != nil {
+		flash := fmt.Sprintf(t("flash_error_text"), result.Error.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, MailURL(), http.StatusFound)
+		return
+	}
+	if result.RowsAffected == 0 {
+		flash := fmt.Sprintf(t("flash_mail_not_found"), id)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, MailURL(), http.StatusFound)
+		return
+	}
+
+	flash := fmt.Sprintf(t("flash_deleted"), fmt.Sprintf("#%d", id))
+	SetFlash(w, F_INFO, flash)
+	http.Redirect(w, r, MailURL(), http.StatusFound)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"fmt"
+	"net"
+	"strings"
+	"strconv"
+	"net/http"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/julienschmidt/httprouter"
+)
+
+func (domain *Domain) StsHosts() []string {
+	hosts := strings.Fields(domain.StsMX)
+	if len(hosts) == 0 {
+		hosts = []string{MX_Host}
+	}
+	return hosts
+}
+
+func (domain *Domain) StsPolicy() string {
+	mode := domain.StsMode
+	if mode == "" {
+		mode = STS_Mode
+	}
+	max_age := domain.StsMaxAge
+	if max_age == 0 {
+		max_age = STS_MaxAge
+	}
+
+	policy := "version: STSv1\r\n"
+	policy += fmt.Sprintf("mode: %s\r\n", mode)
+	for _, host := range domain.StsHosts() {
+		policy += fmt.Sprintf("mx: %s\r\n", host)
+	}
+	policy += fmt.Sprintf("max_age: %d\r\n", max_age)
+
+	return policy
+}
+
+// StsPolicyID is derived from the policy itself, so the _mta-sts
+// record changes exactly when the served policy does.
+func (domain *Domain) StsPolicyID() string {
+	sum := sha256.Sum256([]byte(domain.StsPolicy()))
+	return hex.EncodeToString(sum[:])[:32]
+}
+
+func MtaStsServe(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Printf("INFO  GET /.well-known/mta-sts.txt (%s)", r.Host)
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	name := strings.TrimPrefix(strings.ToLower(host), "mta-sts.")
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	domain := DomainFindByName(name, db)
+	if domain == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, domain.StsPolicy())
+}
+
+func MtaStsDownload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t := RequestTfunc(r)
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	log.Printf("INFO  GET %sdomain/%d/mta-sts", Base_URL, id)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "domain_mta_sts", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	domain := DomainFindByID(id, db)
+	if domain == nil {
+		flash := fmt.Sprintf(t("flash_domain_not_found"), id)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, HomeURL(), http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"mta-sts.%s.txt\"", domain.Name))
+	fmt.Fprint(w, domain.StsPolicy())
+}
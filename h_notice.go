@@ -0,0 +1,227 @@
+package main
+
+import (
+	"log"
+	"fmt"
+	"strconv"
+	"net/url"
+	"net/http"
+	"github.com/julienschmidt/httprouter"
+	"github.com/jinzhu/gorm"
+)
+
+func NoticeURL() string {
+	return Base_URL + "notices"
+}
+
+func NoticeEditURL(kind, lang string, domain_id int) string {
+	query := url.Values{}
+	query.Set("kind", kind)
+	query.Set("lang", lang)
+	query.Set("domain", strconv.Itoa(domain_id))
+	return Base_URL + "notice?" + query.Encode()
+}
+
+// NoticeList shows all kinds of notices per language, and
+// the texts which were changed for all or for one domain.
+func NoticeList(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Printf("INFO  GET %s", NoticeURL())
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "notice_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	if err := db.Order("name").Find(&ctx.Domains).Error; err != nil {
+		log.Printf("ERROR NoticeList:Domains: %s", err)
+	}
+	names := make(map[int]string)
+	for _, domain := range ctx.Domains {
+		names[domain.ID] = domain.Name
+	}
+
+	if err := db.Order("domain_id").Order("kind").Order("language").Find(&ctx.Notices).Error; err != nil {
+		log.Printf("ERROR NoticeList:Notices: %s", err)
+	}
+	for index, _ := range ctx.Notices {
+		ctx.Notices[index].DomainName = names[ctx.Notices[index].DomainID]
+	}
+	ctx.NoticeKinds = Notice_Kinds
+
+	RenderHtml(w, r, "notice_list", ctx)
+}
+
+// NoticeParams checks kind, language and domain of a request,
+// setting a flash and redirecting if one of them is wrong.
+func NoticeParams(w http.ResponseWriter, r *http.Request, db *gorm.DB) (string, string, *Domain, bool) {
+	t := RequestTfunc(r)
+
+	kind := r.FormValue("kind")
+	if !NoticeIsKind(kind) {
+		flash := fmt.Sprintf(t("flash_notice_unknown"), kind)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, NoticeURL(), http.StatusFound)
+		return "", "", nil, false
+	}
+
+	lang := LanguageMatch(r.FormValue("lang"))
+	if lang == "" {
+		lang = Language
+	}
+
+	var domain *Domain
+	if id, _ := strconv.Atoi(r.FormValue("domain")); id != 0 {
+		if domain = DomainFindByID(id, db); domain == nil {
+			flash := fmt.Sprintf(t("flash_domain_not_found"), id)
+			SetFlash(w, F_ERROR, flash)
+			http.Redirect(w, r, NoticeURL(), http.StatusFound)
+			return "", "", nil, false
+		}
+	}
+
+	return kind, lang, domain, true
+}
+
+// NoticeEditRender shows notice with its preview against a made
+// up address, or the error which prevents rendering it.
+func NoticeEditRender(w http.ResponseWriter, r *http.Request, ctx Context, notice *Notice, domain *Domain) {
+	ctx.Notice = notice
+	ctx.Domain = domain
+
+	preview, err := NoticeRender(notice, notice.Language, NoticeSample(domain, notice.Language))
+	if err != nil {
+		ctx.NoticeError = err.Error()
+	} else {
+		ctx.NoticePreview = preview
+	}
+
+	RenderHtml(w, r, "notice_edit", ctx)
+}
+
+func NoticeEdit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Printf("INFO  GET %snotice", Base_URL)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "notice_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	kind, lang, domain, ok := NoticeParams(w, r, db)
+	if !ok {
+		return
+	}
+	domain_id := 0
+	if domain != nil {
+		domain_id = domain.ID
+	}
+
+	// Without an own text the inherited one is the starting point
+	notice := NoticeFind(kind, lang, domain_id, db)
+	if notice == nil {
+		notice = &Notice{}
+	}
+	ctx.NoticeOwn = notice.ID != 0 && notice.DomainID == domain_id && notice.Language == lang
+	if !ctx.NoticeOwn {
+		notice = &Notice{Subject: notice.Subject, Text: notice.Text, HTML: notice.HTML}
+	}
+	notice.Kind = kind
+	notice.Language = lang
+	notice.DomainID = domain_id
+
+	NoticeEditRender(w, r, ctx, notice, domain)
+}
+
+// NoticeUpdate saves, previews or resets (deletes) the text
+// for one kind, language and domain.
+func NoticeUpdate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	t := RequestTfunc(r)
+	log.Printf("INFO  POST %snotice", Base_URL)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "notice_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	kind, lang, domain, ok := NoticeParams(w, r, db)
+	if !ok {
+		return
+	}
+	domain_id := 0
+	if domain != nil {
+		domain_id = domain.ID
+	}
+	back := NoticeEditURL(kind, lang, domain_id)
+
+	existing := &Notice{}
+	err := db.Where("domain_id = ? AND kind = ? AND language = ?", domain_id, kind, lang).First(existing).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, back, http.StatusFound)
+		return
+	}
+	ctx.NoticeOwn = err == nil
+
+	submit := r.FormValue("notice_action")
+	if submit == "reset" {
+		if ctx.NoticeOwn {
+			if err := db.Delete(existing).Error; err != nil {
+				flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+				SetFlash(w, F_ERROR, flash)
+				http.Redirect(w, r, back, http.StatusFound)
+				return
+			}
+			log.Printf("INFO  Notice: reset %s/%s for domain %d", kind, lang, domain_id)
+		}
+		SetFlash(w, F_INFO, t("notice_reset"))
+		http.Redirect(w, r, back, http.StatusFound)
+		return
+	}
+
+	notice := &Notice{
+		DomainID:  domain_id,
+		Kind:      kind,
+		Language:  lang,
+		Subject:   r.FormValue("notice_subject"),
+		Text:      r.FormValue("notice_text"),
+		HTML:      r.FormValue("notice_html"),
+		UpdatedBy: ctx.CurrentAddress.ID,
+	}
+
+	// Broken templates are shown again with the error instead of being saved
+	_, err = NoticeRender(notice, lang, NoticeSample(domain, lang))
+	if submit != "save" || err != nil {
+		NoticeEditRender(w, r, ctx, notice, domain)
+		return
+	}
+
+	if ctx.NoticeOwn {
+		update := make(map[string]interface{})
+		update["subject"] = notice.Subject
+		update["text"] = notice.Text
+		update["html"] = notice.HTML
+		update["updated_by"] = notice.UpdatedBy
+		err = db.Model(existing).Updates(update).Error
+	} else {
+		err = db.Create(notice).Error
+	}
+	if err != nil {
+		flash := fmt.Sprintf(t("flash_error_text"), err.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, back, http.StatusFound)
+		return
+	}
+	log.Printf("INFO  Notice: saved %s/%s for domain %d", kind, lang, domain_id)
+
+	SetFlash(w, F_INFO, t("notice_saved"))
+	http.Redirect(w, r, back, http.StatusFound)
+}
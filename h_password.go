@@ -12,8 +12,7 @@ import (
 	"math/rand"
 	"golang.org/x/crypto/bcrypt"
 	"github.com/julienschmidt/httprouter"
-	"github.com/nicksnyder/go-i18n/i18n"
-	"github.com/jung-kurt/gofpdf"
+	"github.com/jinzhu/gorm"
 )
 
 func PasswordURL() string {
@@ -50,37 +49,44 @@ func PasswordRandom(length int) string {
 	return string(buff)
 }
 
-func PasswordLetter(w http.ResponseWriter, ctx Context, initial string) {
-	t, _ := i18n.Tfunc(Language)
-
-	title := fmt.Sprintf(t("address_email_subject"), ctx.Address.Email)
-
-	pdf := gofpdf.New("P", "mm", "A4", "")
-	pdf.SetTitle(title, true)
-	pdf.AddPage()
-
-	pdf.SetFont("arial", "B", 14)
-	pdf.Write(14, title + "\n")
+// AddressInitial sets a fresh interim password for address,
+// valid until the owner logs in and chooses a new one.
+func AddressInitial(address *Address, uid int, db *gorm.DB) (string, error) {
+	initial := PasswordRandom(10)
+	if err := AddressInitialSave(address, PasswordBcrypt(address.Email, initial), uid, db); err != nil {
+		return "", err
+	}
+	return initial, nil
+}
 
-	pdf.SetFont("arial", "", 14)
-	pdf.Write(14, t("password_email_initial"))
+// AddressInitialSave stores the bcrypt hash of an interim password.
+func AddressInitialSave(address *Address, hash string, uid int, db *gorm.DB) error {
+	update := make(map[string]interface{})
+	update["initial"] = hash
+	update["updated_at"] = time.Now()
+	update["updated_by"] = uid
 
-	pdf.SetFont("courier", "B", 14)
-	pdf.Write(14, initial + "\n")
+	return db.Model(address).Updates(update).Error
+}
 
-	pdf.SetFont("arial", "", 14)
-	pdf.Write(14, t("password_email_info"))
+func PasswordLetter(w http.ResponseWriter, address *Address, initial string, db *gorm.DB) {
+	t := AddressTfunc(address)
 
-	if err := pdf.Output(w); err != nil {
-		log.Printf("ERROR PasswordLetter:Output: %s", err)
+	pdf := LetterNew(fmt.Sprintf(t("address_email_subject"), address.Email))
+	if err := LetterPage(pdf, address, initial, db); err != nil {
+		log.Printf("ERROR PasswordLetter: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	LetterOutput(w, pdf, fmt.Sprintf("%s.pdf", address.Email))
 }
 
 func PasswordEdit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Printf("INFO  GET %s", PasswordURL())
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	ctx := AddressContext(w, r, "password_edit", false, db)
 	if !ctx.LoggedIn {
@@ -91,11 +97,11 @@ func PasswordEdit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 }
 
 func PasswordUpdate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	t, _ := i18n.Tfunc(Language)
+	t := RequestTfunc(r)
 	log.Printf("INFO  POST %s", PasswordURL())
 
-	db := OpenDB(true)
-	defer CloseDB()
+	db := OpenDB(r, true)
+	defer CloseDB(db)
 
 	ctx := AddressContext(w, r, "password_update", false, db)
 	if !ctx.LoggedIn {
@@ -131,6 +137,12 @@ func PasswordUpdate(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 		return
 	}
 
+	WebhookFire(&WebhookPayload{
+		Event:   WEBHOOK_PASSWORD_CHANGED,
+		Actor:   ctx.CurrentAddress.Email,
+		Address: WebhookAddressOf(ctx.CurrentAddress, ""),
+	}, db)
+
 	flash := fmt.Sprintf(t("flash_updated"), t("address_password"))
 	SetFlash(w, F_INFO, flash)
 	http.Redirect(w, r, LogoutURL(), http.StatusFound)
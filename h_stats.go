@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"time"
+	"strconv"
+	"net/http"
+	"github.com/julienschmidt/httprouter"
+	"github.com/jinzhu/gorm"
+)
+
+type StatsRow struct {
+	ID            int
+	Name          string
+	Received      int
+	Sent          int
+	Bounced       int
+	Rejected      int
+	LastLogin     *MailLogin
+}
+
+type StatsReject struct {
+	Sender        string
+	Count         int
+}
+
+func StatsURL() string {
+	return Base_URL + "stats"
+}
+
+func StatsSince(days int) string {
+	return time.Now().AddDate(0, 0, -days).Format("2006-01-02")
+}
+
+// StatsSum adds up mail_stats since the given day, grouped by
+// column (domain_id or address_id).
+func StatsSum(db *gorm.DB, column, since string) []StatsRow {
+	rows := []StatsRow{}
+
+	result, err := db.Model(&MailStat{}).
+		Select(column + ", SUM(received), SUM(sent), SUM(bounced), SUM(rejected)").
+		Where("day >= ?", since).Group(column).
+		Order("SUM(received) + SUM(sent) DESC").Rows()
+	if err != nil {
+		log.Printf("ERROR StatsSum: %s", err)
+		return rows
+	}
+	defer result.Close()
+
+	for result.Next() {
+		row := StatsRow{}
+		if err := result.Scan(&row.ID, &row.Received, &row.Sent, &row.Bounced, &row.Rejected); err != nil {
+			log.Printf("ERROR StatsSum:Scan: %s", err)
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+func StatsRejects(db *gorm.DB, since string, limit int) []StatsReject {
+	rejects := []StatsReject{}
+
+	result, err := db.Model(&MailReject{}).Select("sender, SUM(count)").
+		Where("day >= ?", since).Group("sender").
+		Order("SUM(count) DESC").Limit(limit).Rows()
+	if err != nil {
+		log.Printf("ERROR StatsRejects: %s", err)
+		return rejects
+	}
+	defer result.Close()
+
+	for result.Next() {
+		reject := StatsReject{}
+		if err := result.Scan(&reject.Sender, &reject.Count); err != nil {
+			log.Printf("ERROR StatsRejects:Scan: %s", err)
+			continue
+		}
+		rejects = append(rejects, reject)
+	}
+
+	return rejects
+}
+
+// StatsAddress returns the totals of one address, for the edit page.
+func StatsAddress(address *Address, db *gorm.DB) *StatsRow {
+	row := &StatsRow{ID: address.ID, Name: address.Email}
+
+	for _, sum := range StatsSum(db.Where("address_id = ?", address.ID), "address_id", StatsSince(Stats_Days)) {
+		row.Received, row.Sent, row.Bounced, row.Rejected = sum.Received, sum.Sent, sum.Bounced, sum.Rejected
+	}
+
+	login := &MailLogin{}
+	if err := db.Where("address_id = ?", address.ID).First(login).Error; err == nil {
+		row.LastLogin = login
+	}
+
+	return row
+}
+
+func StatsShow(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Printf("INFO  GET %s", StatsURL())
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "stats_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	ctx.StatsDays = Stats_Days
+	if days, _ := strconv.Atoi(r.FormValue("days")); days > 0 {
+		ctx.StatsDays = days
+	}
+	since := StatsSince(ctx.StatsDays)
+
+	domains := make(map[int]string)
+	for _, domain := range DomainFindAll(db, "") {
+		domains[domain.ID] = domain.Name
+	}
+	ctx.StatsDomains = StatsSum(db, "domain_id", since)
+	for index, _ := range ctx.StatsDomains {
+		ctx.StatsDomains[index].Name = domains[ctx.StatsDomains[index].ID]
+	}
+
+	logins := make(map[int]*MailLogin)
+	login_list := []MailLogin{}
+	if err := db.Find(&login_list).Error; err != nil {
+		log.Printf("ERROR StatsShow:Logins: %s", err)
+	}
+	for index, _ := range login_list {
+		logins[login_list[index].AddressID] = &login_list[index]
+	}
+
+	addresses := make(map[int]string)
+	address_list := []Address{}
+	if err := db.Select("id, email").Find(&address_list).Error; err != nil {
+		log.Printf("ERROR StatsShow:Addresses: %s", err)
+	}
+	for _, address := range address_list {
+		addresses[address.ID] = address.Email
+	}
+	for _, row := range StatsSum(db.Where("address_id <> 0"), "address_id", since) {
+		row.Name = addresses[row.ID]
+		row.LastLogin = logins[row.ID]
+		ctx.StatsAddresses = append(ctx.StatsAddresses, row)
+	}
+
+	ctx.StatsRejects = StatsRejects(db, since, 10)
+
+	RenderHtml(w, r, "stats", ctx)
+}
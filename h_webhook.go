@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"fmt"
+	"time"
+	"strconv"
+	"net/http"
+	"github.com/julienschmidt/httprouter"
+)
+
+func WebhookURL() string {
+	return Base_URL + "webhooks"
+}
+
+// WebhookShow lists the targets and the delivery log, latest first.
+func WebhookShow(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Printf("INFO  GET %s", WebhookURL())
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "webhook_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	if err := db.Order("id DESC").Limit(200).Find(&ctx.WebhookDeliveries).Error; err != nil {
+		log.Printf("ERROR WebhookShow: %s", err)
+	}
+	ctx.WebhookTargets = Webhooks
+
+	RenderHtml(w, r, "webhooks", ctx)
+}
+
+// WebhookRetry delivers again right away, with a fresh number of
+// attempts. Delivered ones can be sent again as well.
+func WebhookRetry(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t := RequestTfunc(r)
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	log.Printf("INFO  POST %swebhooks/%d/retry", Base_URL, id)
+
+	db := OpenDB(r, true)
+	defer CloseDB(db)
+
+	ctx := AddressContext(w, r, "webhook_title", true, db)
+	if !ctx.LoggedIn {
+		return
+	}
+
+	update := make(map[string]interface{})
+	update["status"] = WEBHOOK_PENDING
+	update["attempts"] = 0
+	update["next_attempt"] = time.Now()
+	result := db.Model(&WebhookDelivery{}).Where("id = ? AND status <> ?", id, WEBHOOK_SENDING).Updates(update)
+	if result.Error != nil {
+		flash := fmt.Sprintf(t("flash_error_text"), result.Error.Error())
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, WebhookURL(), http.StatusFound)
+		return
+	}
+	if result.RowsAffected == 0 {
+		flash := fmt.Sprintf(t("flash_webhook_not_found"), id)
+		SetFlash(w, F_ERROR, flash)
+		http.Redirect(w, r, WebhookURL(), http.StatusFound)
+		return
+	}
+	WebhookWake()
+
+	SetFlash(w, F_INFO, t("webhook_retried"))
+	http.Redirect(w, r, WebhookURL(), http.StatusFound)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"os"
+	"io"
+	"log"
+	"fmt"
+	"time"
+	"errors"
+	"context"
+	"strings"
+	"os/exec"
+	"path/filepath"
+	"archive/tar"
+	"compress/gzip"
+)
+
+const (
+	HOOK_CREATE = "create"
+	HOOK_RENAME = "rename"
+	HOOK_MOVE   = "move"
+	HOOK_DELETE = "delete"
+)
+
+// HookFailure is an action which failed for an address and can be
+// retried from the UI. Successful actions leave no trace.
+type HookFailure struct {
+	ID            int         `gorm:"primary_key"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Event         string
+	Action        string      `gorm:"type:text"`
+	AddressID     int         `gorm:"index"`
+	Email         string
+	OldEmail      string
+	Attempts      int
+	LastError     string      `gorm:"type:text"`
+}
+
+// HookActions returns the configured actions for event. Besides the
+// built-in maildir, rename and archive every entry is a shell command.
+func HookActions(event string) []string {
+	switch event {
+	case HOOK_CREATE:
+		return Hook_Create
+	case HOOK_RENAME:
+		return Hook_Rename
+	case HOOK_MOVE:
+		return Hook_Move
+	case HOOK_DELETE:
+		return Hook_Delete
+	}
+	return nil
+}
+
+// MaildirPath is the home of email below Mail_Root, the same
+// as in the Dovecot user_query. The hooks create, move and remove
+// it, so anything but a directory two levels down is refused.
+func MaildirPath(email string) (string, error) {
+	parts := strings.SplitN(email, "@", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("no maildir for %q", email)
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\") {
+			return "", fmt.Errorf("no maildir for %q", email)
+		}
+	}
+
+	root := filepath.Clean(Mail_Root)
+	home := filepath.Join(root, parts[1], parts[0])
+	if filepath.Dir(filepath.Dir(home)) != root {
+		return "", fmt.Errorf("no maildir for %q", email)
+	}
+	return home, nil
+}
+
+// MaildirChown hands path to Mail_UID and Mail_GID, since
+// Dovecot runs as the virtual mail user, not as postfix-go.
+func MaildirChown(path string) error {
+	if Mail_UID == 0 && Mail_GID == 0 {
+		return nil
+	}
+	return filepath.Walk(path, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, Mail_UID, Mail_GID)
+	})
+}
+
+// HookFire runs the actions for event on the address with id. For
+// rename and move old_email is the address before the change. Every
+// failure is stored for a retry, the returned error is for the flash.
+// Actions may take Hook_Timeout each, longer than a request may use
+// its database, so the failures are stored without that limit.
+func HookFire(event string, id int, email, old_email string) error {
+	db := OpenDB(nil, false)
+	defer CloseDB(db)
+
+	errs := []string{}
+	for _, action := range HookActions(event) {
+		err := HookRun(event, action, email, old_email)
+		if err == nil {
+			continue
+		}
+		log.Printf("ERROR Hook:%s: %s: %s", event, email, err)
+		errs = append(errs, err.Error())
+
+		failure := &HookFailure{
+			Event:     event,
+			Action:    action,
+			AddressID: id,
+			Email:     email,
+			OldEmail:  old_email,
+			Attempts:  1,
+			LastError: err.Error(),
+		}
+		if err := db.Create(failure).Error; err != nil {
+			log.Printf("ERROR HookFire:Create: %s", err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func HookRun(event, action, email, old_email string) error {
+	log.Printf("INFO  Hook:%s: %s %s", event, action, email)
+
+	switch action {
+	case "maildir":
+		return HookMaildir(email)
+	case "rename":
+		return HookRename(email, old_email)
+	case "archive":
+		return HookArchive(email)
+	}
+	return HookCommand(event, action, email, old_email)
+}
+
+// HookRetry runs a failed action again, removing it on success.
+func HookRetry(failure *HookFailure) error {
+	err := HookRun(failure.Event, failure.Action, failure.Email, failure.OldEmail)
+
+	db := OpenDB(nil, false)
+	defer CloseDB(db)
+
+	if err == nil {
+		return db.Delete(failure).Error
+	}
+
+	update := make(map[string]interface{})
+	update["attempts"] = failure.Attempts + 1
+	update["last_error"] = err.Error()
+	update["updated_at"] = time.Now()
+	if err := db.Model(failure).Updates(update).Error; err != nil {
+		log.Printf("ERROR HookRetry:Updates: %s", err)
+	}
+	return err
+}
+
+// HookMaildir creates an empty maildir. The sieve onboarding builds
+// on it, so with sieve in Onboard_Actions it needn't be in Hook_Create.
+func HookMaildir(email string) error {
+	home, err := MaildirPath(email)
+	if err != nil {
+		return err
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(home, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return MaildirChown(home)
+}
+
+// HookRename moves the maildir along with the address. Nothing
+// to do if there is none yet, Dovecot creates it on first use.
+func HookRename(email, old_email string) error {
+	if old_email == "" || old_email == email {
+		return nil
+	}
+	source, err := MaildirPath(old_email)
+	if err != nil {
+		return err
+	}
+	target, err := MaildirPath(email)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(source); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("%s exists already", target)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Rename(source, target)
+}
+
+// HookArchive packs the maildir into a tarball in Hook_Archive
+// and removes it, the database row is gone already.
+func HookArchive(email string) error {
+	home, err := MaildirPath(email)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(home); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(Hook_Archive, 0700); err != nil {
+		return err
+	}
+
+	name := filepath.Join(Hook_Archive, fmt.Sprintf("%s-%s.tar.gz", email, time.Now().Format("20060102-150405")))
+	file, err := os.OpenFile(name, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	zipper := gzip.NewWriter(file)
+	archive := tar.NewWriter(zipper)
+
+	base := filepath.Dir(home)
+	err = filepath.Walk(home, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		if header.Name, err = filepath.Rel(base, path); err != nil {
+			return err
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		source, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		_, err = io.Copy(archive, source)
+		return err
+	})
+	if err == nil {
+		err = archive.Close()
+	}
+	if err == nil {
+		err = zipper.Close()
+	}
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+
+	log.Printf("INFO  Hook: %s archived to %s", home, name)
+	return os.RemoveAll(home)
+}
+
+// HookCommand runs action with the shell, the details are
+// passed in the environment.
+func HookCommand(event, action, email, old_email string) error {
+	home, err := MaildirPath(email)
+	if err != nil {
+		return err
+	}
+	old_home := ""
+	if old_email != "" {
+		if old_home, err = MaildirPath(old_email); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(Hook_Timeout) * time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", action)
+	cmd.Env = append(os.Environ(),
+		"HOOK_EVENT=" + event,
+		"HOOK_EMAIL=" + email,
+		"HOOK_MAILDIR=" + home,
+		"HOOK_OLD_EMAIL=" + old_email,
+		"MAIL_ROOT=" + Mail_Root,
+	)
+	if old_email != "" {
+		cmd.Env = append(cmd.Env, "HOOK_OLD_MAILDIR=" + old_home)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s: %s", action, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMaildirPath(t *testing.T) {
+	Mail_Root = "/var/vmail/"
+
+	home, err := MaildirPath("info@example.com")
+	if err != nil || home != "/var/vmail/example.com/info" {
+		t.Errorf("MaildirPath(info@example.com) = %q, %v", home, err)
+	}
+
+	// None of these may reach the domain directory or Mail_Root
+	for _, email := range []string{
+		"@example.com", ".@example.com", "..@example.com", "a/b@example.com",
+		"../x@example.com", "info@", "info@..", "info@a/..", "info", "",
+	} {
+		if home, err := MaildirPath(email); err == nil {
+			t.Errorf("MaildirPath(%q) = %q, want an error", email, home)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"os"
+	"log"
+	"fmt"
+	"flag"
+	"sort"
+	"bytes"
+	"regexp"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+	"github.com/nicksnyder/go-i18n/i18n/language"
+)
+
+// LocaleEntry is one message of a locales/*.all.json file. Plural
+// messages map the CLDR categories (one, other, ...) to their text
+// and are called as t(id, count).
+type LocaleEntry struct {
+	ID            string
+	Text          string
+	Plural        map[string]string
+}
+
+type LocaleIssue struct {
+	Kind          string
+	ID            string
+	Detail        string
+}
+
+const (
+	LOCALE_MISSING     = "missing"
+	LOCALE_EMPTY       = "empty"
+	LOCALE_UNUSED      = "unused"
+	LOCALE_EXTRA       = "extra"
+	LOCALE_PLACEHOLDER = "placeholder"
+	LOCALE_PLURAL      = "plural"
+)
+
+var (
+	localeTemplateRefs = regexp.MustCompile(`\bT\s+"([a-z][a-z0-9_]*)"`)
+	localePrefixRefs   = regexp.MustCompile(`\bT\s+\(printf\s+"([a-z][a-z0-9_]*)%`)
+	localeGoRefs       = regexp.MustCompile(`\bt\("([a-z][a-z0-9_]*)"|AddressContext\(w, r, "([a-z][a-z0-9_]*)"|Title:\s*"([a-z][a-z0-9_]*)"`)
+	localeLiterals     = regexp.MustCompile(`"([a-z][a-z0-9_]*)"`)
+	localeVerbs        = regexp.MustCompile(`%[-+# 0-9.]*[a-zA-Z%]`)
+)
+
+// Keys looked up without a literal in the sources
+var localeImplicit = []string{"lang_name", "xxx"}
+
+func LocaleRead(path string) ([]LocaleEntry, error) {
+	raw := []struct {
+		ID          string          `json:"id"`
+		Translation json.RawMessage `json:"translation"`
+	}{}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	entries := []LocaleEntry{}
+	for _, item := range raw {
+		entry := LocaleEntry{ID: item.ID}
+		if err := json.Unmarshal(item.Translation, &entry.Text); err != nil {
+			if err := json.Unmarshal(item.Translation, &entry.Plural); err != nil {
+				return nil, fmt.Errorf("%s: %s: %s", path, item.ID, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// LocaleWrite keeps the layout of the hand written files,
+// one message per line with the translations tab aligned.
+func LocaleWrite(path string, entries []LocaleEntry) error {
+	buf := bytes.Buffer{}
+	buf.WriteString("[\n")
+	for index, entry := range entries {
+		line := fmt.Sprintf(`  { "id": "%s",`, entry.ID)
+		if len(line) >= 40 {
+			line += " "
+		}
+		for col := len(line); col < 40; col = (col / 8 + 1) * 8 {
+			line += "\t"
+		}
+
+		translation := LocaleQuote(entry.Text)
+		if entry.Plural != nil {
+			forms := []string{}
+			for _, form := range []string{"zero", "one", "two", "few", "many", "other"} {
+				if text, ok := entry.Plural[form]; ok {
+					forms = append(forms, fmt.Sprintf("%q: %s", form, LocaleQuote(text)))
+				}
+			}
+			translation = "{ " + strings.Join(forms, ", ") + " }"
+		}
+		fmt.Fprintf(&buf, "%s\"translation\": %s }", line, translation)
+
+		if index < len(entries) - 1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("]\n")
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// LocaleQuote is json.Marshal without escaping <, > and &.
+func LocaleQuote(text string) string {
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(text)
+	return strings.TrimSpace(buf.String())
+}
+
+// LocaleScan collects the message IDs the sources refer to. Refs are
+// looked up directly (T or t with a literal, page titles), prefixes
+// come from T with printf and literals are all other snake_case
+// strings, which might be IDs passed around in constants.
+func LocaleScan() (refs, prefixes, literals map[string]bool, err error) {
+	refs     = make(map[string]bool)
+	prefixes = make(map[string]bool)
+	literals = make(map[string]bool)
+
+	for _, id := range localeImplicit {
+		literals[id] = true
+	}
+
+	templates, err := filepath.Glob("templates/*")
+	if err != nil {
+		return
+	}
+	for _, path := range templates {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, match := range localeTemplateRefs.FindAllStringSubmatch(string(data), -1) {
+			refs[match[1]] = true
+		}
+		for _, match := range localePrefixRefs.FindAllStringSubmatch(string(data), -1) {
+			prefixes[match[1]] = true
+		}
+	}
+
+	sources, err := filepath.Glob("*.go")
+	if err != nil {
+		return
+	}
+	for _, path := range sources {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, match := range localeGoRefs.FindAllStringSubmatch(string(data), -1) {
+			refs[match[1] + match[2] + match[3]] = true
+		}
+		for _, match := range localeLiterals.FindAllStringSubmatch(string(data), -1) {
+			literals[match[1]] = true
+		}
+	}
+
+	return refs, prefixes, literals, nil
+}
+
+// LocaleVerbs returns the fmt placeholders of text in order.
+func LocaleVerbs(text string) string {
+	verbs := []string{}
+	for _, verb := range localeVerbs.FindAllString(text, -1) {
+		if verb != "%%" {
+			verbs = append(verbs, verb)
+		}
+	}
+	return strings.Join(verbs, " ")
+}
+
+// LocaleCheck compares one locale with the sources and, unless it
+// is the default locale itself, with the default locale.
+func LocaleCheck(lang string, entries, defaults []LocaleEntry, refs, prefixes, literals map[string]bool) []LocaleIssue {
+	issues := []LocaleIssue{}
+
+	have := make(map[string]LocaleEntry)
+	for _, entry := range entries {
+		have[entry.ID] = entry
+	}
+	want := make(map[string]LocaleEntry)
+	for _, entry := range defaults {
+		want[entry.ID] = entry
+	}
+
+	ids := []string{}
+	for id, _ := range refs {
+		ids = append(ids, id)
+	}
+	for id, _ := range want {
+		if !refs[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		entry, ok := have[id]
+		if !ok {
+			issues = append(issues, LocaleIssue{Kind: LOCALE_MISSING, ID: id})
+			continue
+		}
+		if entry.Text == "" && len(entry.Plural) == 0 {
+			issues = append(issues, LocaleIssue{Kind: LOCALE_EMPTY, ID: id})
+		}
+	}
+
+	spec := language.GetPluralSpec(lang)
+	for _, entry := range entries {
+		used := refs[entry.ID] || literals[entry.ID]
+		for prefix, _ := range prefixes {
+			used = used || strings.HasPrefix(entry.ID, prefix)
+		}
+		if !used {
+			issues = append(issues, LocaleIssue{Kind: LOCALE_UNUSED, ID: entry.ID})
+		}
+
+		base, ok := want[entry.ID]
+		if !ok {
+			if len(defaults) > 0 {
+				issues = append(issues, LocaleIssue{Kind: LOCALE_EXTRA, ID: entry.ID})
+			}
+			base = entry
+		}
+
+		expect := LocaleVerbs(base.Text)
+		if base.Plural != nil {
+			expect = LocaleVerbs(base.Plural["other"])
+		}
+		if entry.Plural == nil {
+			if base.Plural != nil {
+				issues = append(issues, LocaleIssue{Kind: LOCALE_PLURAL, ID: entry.ID, Detail: "not plural"})
+			}
+			if verbs := LocaleVerbs(entry.Text); entry.Text != "" && verbs != expect {
+				issues = append(issues, LocaleIssue{Kind: LOCALE_PLACEHOLDER, ID: entry.ID, Detail: fmt.Sprintf("%q, want %q", verbs, expect)})
+			}
+			continue
+		}
+
+		if base.Plural == nil {
+			issues = append(issues, LocaleIssue{Kind: LOCALE_PLURAL, ID: entry.ID, Detail: "should not be plural"})
+		}
+		if spec != nil {
+			for plural, _ := range spec.Plurals {
+				if _, ok := entry.Plural[string(plural)]; !ok {
+					issues = append(issues, LocaleIssue{Kind: LOCALE_PLURAL, ID: entry.ID, Detail: "no form " + string(plural)})
+				}
+			}
+		}
+		forms := []string{}
+		for form, _ := range entry.Plural {
+			forms = append(forms, form)
+		}
+		sort.Strings(forms)
+		for _, form := range forms {
+			if entry.Plural[form] == "" {
+				issues = append(issues, LocaleIssue{Kind: LOCALE_EMPTY, ID: entry.ID, Detail: form})
+			}
+			if spec != nil {
+				if _, ok := spec.Plurals[language.Plural(form)]; !ok {
+					issues = append(issues, LocaleIssue{Kind: LOCALE_PLURAL, ID: entry.ID, Detail: "unknown form " + form})
+				}
+			}
+			if verbs := LocaleVerbs(entry.Plural[form]); entry.Plural[form] != "" && verbs != expect {
+				issues = append(issues, LocaleIssue{Kind: LOCALE_PLACEHOLDER, ID: entry.ID, Detail: fmt.Sprintf("%s: %q, want %q", form, verbs, expect)})
+			}
+		}
+	}
+
+	return issues
+}
+
+func LocaleCheckAll() int {
+	refs, prefixes, literals, err := LocaleScan()
+	if err != nil {
+		log.Printf("ERROR I18n: %s", err)
+		return 1
+	}
+
+	defaults, err := LocaleRead(fmt.Sprintf("locales/%s.all.json", Language))
+	if err != nil {
+		log.Printf("ERROR I18n: %s", err)
+		return 1
+	}
+
+	files, err := filepath.Glob("locales/*.all.json")
+	if err != nil {
+		log.Printf("ERROR I18n: %s", err)
+		return 1
+	}
+
+	// Unused and extra messages are only reported
+	count := 0
+	for _, path := range files {
+		lang := strings.TrimSuffix(filepath.Base(path), ".all.json")
+		entries, err := LocaleRead(path)
+		if err != nil {
+			log.Printf("ERROR I18n: %s", err)
+			return 1
+		}
+
+		compare := defaults
+		if lang == Language {
+			compare = nil
+		}
+		for _, issue := range LocaleCheck(lang, entries, compare, refs, prefixes, literals) {
+			fmt.Printf("%-24s %-12s %-32s %s\n", path, issue.Kind, issue.ID, issue.Detail)
+			if issue.Kind != LOCALE_UNUSED && issue.Kind != LOCALE_EXTRA {
+				count++
+			}
+		}
+	}
+
+	if count > 0 {
+		fmt.Printf("%d errors found\n", count)
+		return 1
+	}
+	return 0
+}
+
+// LocaleSkeleton writes locales/<lang>.all.json with all messages of
+// the default locale. Existing translations are kept, new messages
+// get an empty text, which falls back to the default language.
+func LocaleSkeleton(lang string) int {
+	defaults, err := LocaleRead(fmt.Sprintf("locales/%s.all.json", Language))
+	if err != nil {
+		log.Printf("ERROR I18n: %s", err)
+		return 1
+	}
+
+	path := fmt.Sprintf("locales/%s.all.json", lang)
+	have := make(map[string]LocaleEntry)
+	if _, err := os.Stat(path); err == nil {
+		entries, err := LocaleRead(path)
+		if err != nil {
+			log.Printf("ERROR I18n: %s", err)
+			return 1
+		}
+		for _, entry := range entries {
+			have[entry.ID] = entry
+		}
+	}
+
+	spec := language.GetPluralSpec(lang)
+	added := 0
+	entries := []LocaleEntry{}
+	for _, base := range defaults {
+		if entry, ok := have[base.ID]; ok {
+			entries = append(entries, entry)
+			continue
+		}
+
+		entry := LocaleEntry{ID: base.ID}
+		switch {
+		case base.ID == "lang_name":
+			entry.Text = lang
+		case base.ID == "xxx":
+			entry.Text = base.Text
+		case base.Plural != nil:
+			entry.Plural = make(map[string]string)
+			if spec != nil {
+				for plural, _ := range spec.Plurals {
+					entry.Plural[string(plural)] = ""
+				}
+			} else {
+				entry.Plural["other"] = ""
+			}
+		}
+		entries = append(entries, entry)
+		added++
+	}
+
+	if err := LocaleWrite(path, entries); err != nil {
+		log.Printf("ERROR I18n: %s", err)
+		return 1
+	}
+	fmt.Printf("%s: %d messages added\n", path, added)
+
+	return 0
+}
+
+func I18nCommand(args []string) int {
+	flags := flag.NewFlagSet("i18n", flag.ExitOnError)
+	flags.Parse(args)
+
+	switch {
+	case flags.Arg(0) == "check" && flags.NArg() == 1:
+		return LocaleCheckAll()
+	case flags.Arg(0) == "skeleton" && flags.NArg() == 2:
+		return LocaleSkeleton(flags.Arg(1))
+	}
+
+	fmt.Fprintf(os.Stderr, "usage: postfix-go i18n check | skeleton lang\n")
+	return 2
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"os"
+	"io"
+	"log"
+	"fmt"
+	"time"
+	"bytes"
+	"strings"
+	"os/exec"
+	"net/mail"
+	"path/filepath"
+	"sync/atomic"
+	"github.com/jinzhu/gorm"
+	"gopkg.in/gomail.v2"
+)
+
+const (
+	MAIL_PENDING = QUEUE_PENDING
+	MAIL_SENDING = QUEUE_SENDING
+	MAIL_FAILED  = "failed"
+)
+
+// QueuedMail is a notification waiting to be sent. Body holds the
+// complete message, Recipients the envelope addresses (including Bcc).
+// Sent messages are removed from the queue.
+type QueuedMail struct {
+	ID            int         `gorm:"primary_key"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Sender        string
+	Recipients    string      `gorm:"type:text"`
+	Subject       string
+	Body          string      `gorm:"type:text"`
+	Status        string      `gorm:"index"`
+	Attempts      int
+	NextAttempt   time.Time   `gorm:"index"`
+	LastError     string      `gorm:"type:text"`
+}
+
+func (QueuedMail) TableName() string { return "mail_queue" }
+
+// MailTransport delivers one message to its envelope recipients.
+type MailTransport interface {
+	Name() string
+	Send(from string, to []string, body []byte) error
+}
+
+type MailSMTP struct {
+	dialer        *gomail.Dialer
+}
+
+type MailSendmail struct {
+	path          string
+}
+
+type MailMaildir struct {
+	dir           string
+}
+
+// MailBody lets gomail send a message that was rendered before.
+type MailBody []byte
+
+var (
+	Mail_Sender   MailTransport
+	Mail_Queue    = QueueNew("mail", &QueuedMail{}, func() interface{} { return &[]QueuedMail{} }, MailWork)
+	mail_count    int64
+)
+
+func (body MailBody) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(body)
+	return int64(n), err
+}
+
+func (t *MailSMTP) Name() string {
+	return fmt.Sprintf("smtp %s:%d", t.dialer.Host, t.dialer.Port)
+}
+
+func (t *MailSMTP) Send(from string, to []string, body []byte) error {
+	conn, err := t.dialer.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Send(from, to, MailBody(body))
+}
+
+func (t *MailSendmail) Name() string {
+	return "sendmail " + t.path
+}
+
+func (t *MailSendmail) Send(from string, to []string, body []byte) error {
+	args := append([]string{"-i", "-f", from, "--"}, to...)
+	cmd := exec.Command(t.path, args...)
+	cmd.Stdin = bytes.NewReader(body)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (t *MailMaildir) Name() string {
+	return "maildir " + t.dir
+}
+
+// Send stores the message in the new folder of a maildir, so any
+// mail client can show what would have been sent.
+func (t *MailMaildir) Send(from string, to []string, body []byte) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%d_%d.%s", time.Now().Unix(), os.Getpid(), atomic.AddInt64(&mail_count, 1), host)
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "Return-Path: <%s>\r\n", from)
+	for _, rcpt := range to {
+		fmt.Fprintf(&buf, "Delivered-To: %s\r\n", rcpt)
+	}
+	buf.Write(body)
+
+	tmp := filepath.Join(t.dir, "tmp", name)
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.dir, "new", name))
+}
+
+func MailTransportNew(name string) (MailTransport, error) {
+	switch name {
+	case "smtp":
+		return &MailSMTP{dialer: gomail.NewDialer(SMTP_Host, SMTP_Port, SMTP_Username, SMTP_Password)}, nil
+	case "sendmail":
+		return &MailSendmail{path: Mail_Sendmail}, nil
+	case "maildir":
+		return &MailMaildir{dir: Mail_Spool}, nil
+	case "catcher":
+		if ProdMode {
+			return nil, fmt.Errorf("mail transport catcher is for development only")
+		}
+		Mail_Catcher = &MailCatcher{}
+		return Mail_Catcher, nil
+	}
+	return nil, fmt.Errorf("unknown mail transport %s", name)
+}
+
+// MailInit starts the dispatcher and the workers. Messages left
+// in sending state by a crash are sent again.
+func MailInit() {
+	transport, err := MailTransportNew(Mail_Transport)
+	if err != nil {
+		log.Printf("FATAL MailInit: %s", err)
+		os.Exit(1)
+	}
+	Mail_Sender = transport
+	log.Printf("INFO  Mail transport %s", Mail_Sender.Name())
+
+	Mail_Queue.Start(Mail_Workers, Mail_Interval)
+}
+
+// MailEnqueue stores the message for the workers. Errors only
+// concern the queue itself, delivery errors are retried later.
+func MailEnqueue(message *gomail.Message, db *gorm.DB) error {
+	from := ""
+	if list, err := mail.ParseAddressList(strings.Join(message.GetHeader("From"), ", ")); err == nil && len(list) > 0 {
+		from = list[0].Address
+	}
+
+	to := []string{}
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		header := message.GetHeader(field)
+		if len(header) == 0 {
+			continue
+		}
+		list, err := mail.ParseAddressList(strings.Join(header, ", "))
+		if err != nil {
+			return fmt.Errorf("%s: %s", field, err)
+		}
+		for _, addr := range list {
+			to = append(to, addr.Address)
+		}
+	}
+	if len(to) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+
+	body := bytes.Buffer{}
+	if _, err := message.WriteTo(&body); err != nil {
+		return err
+	}
+
+	queued := &QueuedMail{
+		Sender:      from,
+		Recipients:  strings.Join(to, ", "),
+		Subject:     strings.Join(message.GetHeader("Subject"), " "),
+		Body:        body.String(),
+		Status:      MAIL_PENDING,
+		NextAttempt: time.Now(),
+	}
+	if err := db.Create(queued).Error; err != nil {
+		return err
+	}
+	log.Printf("INFO  Mail %d queued for %s", queued.ID, queued.Recipients)
+
+	MailWake()
+	return nil
+}
+
+func MailWake() {
+	Mail_Queue.Wake()
+}
+
+func MailWork(job interface{}) {
+	mail := job.(*QueuedMail)
+	err := Mail_Sender.Send(mail.Sender, strings.Split(mail.Recipients, ", "), []byte(mail.Body))
+
+	db := OpenDB(nil, false)
+	MailDone(mail, err, db)
+	CloseDB(db)
+}
+
+// MailDone removes a sent message or schedules the next attempt,
+// doubling the delay each time until Mail_Retries is reached.
+func MailDone(mail *QueuedMail, send_err error, db *gorm.DB) {
+	if send_err == nil {
+		log.Printf("INFO  Mail %d sent to %s", mail.ID, mail.Recipients)
+		if err := db.Delete(mail).Error; err != nil {
+			log.Printf("ERROR MailDone:Delete: %s", err)
+		}
+		return
+	}
+
+	update := make(map[string]interface{})
+	update["attempts"] = mail.Attempts + 1
+	update["last_error"] = send_err.Error()
+	update["updated_at"] = time.Now()
+	if mail.Attempts + 1 >= Mail_Retries {
+		log.Printf("ERROR Mail %d to %s failed: %s", mail.ID, mail.Recipients, send_err)
+		update["status"] = MAIL_FAILED
+	} else {
+		delay := QueueDelay(Mail_Backoff, mail.Attempts)
+		log.Printf("INFO  Mail %d to %s deferred for %s: %s", mail.ID, mail.Recipients, delay, send_err)
+		update["status"] = MAIL_PENDING
+		update["next_attempt"] = time.Now().Add(delay)
+	}
+
+	if err := db.Model(mail).Updates(update).Error; err != nil {
+		log.Printf("ERROR MailDone:Updates: %s", err)
+	}
+}
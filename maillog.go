@@ -0,0 +1,413 @@
+package main
+
+import (
+	"os"
+	"io"
+	"log"
+	"fmt"
+	"flag"
+	"time"
+	"bufio"
+	"regexp"
+	"strings"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	LOG_RECEIVED = "received"
+	LOG_SENT     = "sent"
+	LOG_BOUNCED  = "bounced"
+	LOG_REJECTED = "rejected"
+	LOG_LOGIN    = "login"
+)
+
+type LogEvent struct {
+	At            time.Time
+	Kind          string
+	Email         string
+	Sender        string
+	Protocol      string
+	RemoteIP      string
+}
+
+// MailStat counts the events of one day per address. AddressID
+// is 0 for recipients in our domains without a mailbox.
+type MailStat struct {
+	ID            int         `gorm:"primary_key"`
+	Day           string      `gorm:"index"`
+	DomainID      int         `gorm:"index"`
+	AddressID     int         `gorm:"index"`
+	Received      int
+	Sent          int
+	Bounced       int
+	Rejected      int
+}
+
+type MailReject struct {
+	ID            int         `gorm:"primary_key"`
+	Day           string      `gorm:"index"`
+	DomainID      int         `gorm:"index"`
+	Sender        string
+	Count         int
+}
+
+type MailLogin struct {
+	AddressID     int         `gorm:"primary_key;auto_increment:false"`
+	LoginAt       time.Time
+	Protocol      string
+	RemoteIP      string
+}
+
+// MailLogFile remembers how far a log file has been read.
+type MailLogFile struct {
+	Path          string      `gorm:"primary_key"`
+	Offset        int64
+	UpdatedAt     time.Time
+}
+
+type LogParser struct {
+	Now           time.Time
+	Senders       map[string]string
+}
+
+var (
+	LogLineSyslog  = regexp.MustCompile(`^([A-Z][a-z]{2} [ 0-9]\d \d\d:\d\d:\d\d) \S+ ([^\[:]+)(?:\[\d+\])?: (.*)$`)
+	LogLineISO     = regexp.MustCompile(`^(\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(?:\.\d+)?(?:Z|[+-]\d\d:?\d\d)?) \S+ ([^\[:]+)(?:\[\d+\])?: (.*)$`)
+	LogQmgrFrom    = regexp.MustCompile(`^([0-9A-Za-z]+): from=<([^>]*)>`)
+	LogRemoved     = regexp.MustCompile(`^([0-9A-Za-z]+): removed$`)
+	LogSasl        = regexp.MustCompile(`^([0-9A-Za-z]+): client=.*sasl_username=([^,\s]+)`)
+	LogDelivery    = regexp.MustCompile(`^([0-9A-Za-z]+): to=<([^>]*)>.*, status=(sent|bounced)`)
+	LogReject      = regexp.MustCompile(`^NOQUEUE: reject: RCPT from \S+: .*; from=<([^>]*)> to=<([^>]*)>`)
+	LogLogin       = regexp.MustCompile(`^(imap|pop3)-login: Login: user=<([^>]+)>(?:.*rip=([0-9A-Fa-f:.]+))?`)
+	Log_Parser     = NewLogParser()
+)
+
+func (MailStat) TableName() string    { return "mail_stats" }
+func (MailReject) TableName() string  { return "mail_rejects" }
+func (MailLogin) TableName() string   { return "mail_logins" }
+func (MailLogFile) TableName() string { return "mail_log_files" }
+
+func NewLogParser() *LogParser {
+	return &LogParser{Senders: make(map[string]string)}
+}
+
+// Parse turns one syslog line of Postfix or Dovecot into an event,
+// or returns nil if the line is of no interest. Lines of one queue
+// ID must be parsed in order, the sender is only logged by qmgr.
+func (parser *LogParser) Parse(line string) *LogEvent {
+	now := parser.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var at time.Time
+	var prog, text string
+	if m := LogLineSyslog.FindStringSubmatch(line); m != nil {
+		tm, err := time.ParseInLocation("Jan _2 15:04:05 2006", fmt.Sprintf("%s %d", m[1], now.Year()), time.Local)
+		if err != nil {
+			return nil
+		}
+		// The classic format has no year, so December lines
+		// read in January belong to the previous year
+		if tm.After(now.Add(24 * time.Hour)) {
+			tm = tm.AddDate(-1, 0, 0)
+		}
+		at, prog, text = tm, m[2], m[3]
+	} else if m := LogLineISO.FindStringSubmatch(line); m != nil {
+		tm, err := time.Parse(time.RFC3339Nano, m[1])
+		if err != nil {
+			return nil
+		}
+		at, prog, text = tm, m[2], m[3]
+	} else {
+		return nil
+	}
+
+	if prog == "dovecot" {
+		if m := LogLogin.FindStringSubmatch(text); m != nil {
+			return &LogEvent{At: at, Kind: LOG_LOGIN, Email: strings.ToLower(m[2]), Protocol: m[1], RemoteIP: m[3]}
+		}
+		return nil
+	}
+	if !strings.HasPrefix(prog, "postfix") {
+		return nil
+	}
+
+	if m := LogQmgrFrom.FindStringSubmatch(text); m != nil && strings.HasSuffix(prog, "/qmgr") {
+		parser.Senders[m[1]] = strings.ToLower(m[2])
+		return nil
+	}
+	if m := LogRemoved.FindStringSubmatch(text); m != nil {
+		delete(parser.Senders, m[1])
+		return nil
+	}
+	if m := LogSasl.FindStringSubmatch(text); m != nil {
+		return &LogEvent{At: at, Kind: LOG_SENT, Email: strings.ToLower(m[2])}
+	}
+	if m := LogReject.FindStringSubmatch(text); m != nil {
+		return &LogEvent{At: at, Kind: LOG_REJECTED, Email: strings.ToLower(m[2]), Sender: strings.ToLower(m[1])}
+	}
+	if m := LogDelivery.FindStringSubmatch(text); m != nil {
+		sender := parser.Senders[m[1]]
+		if m[3] == "bounced" {
+			return &LogEvent{At: at, Kind: LOG_BOUNCED, Email: sender, Sender: sender}
+		}
+		// Remote deliveries are counted as sent by the SASL line
+		if strings.HasSuffix(prog, "/smtp") {
+			return nil
+		}
+		return &LogEvent{At: at, Kind: LOG_RECEIVED, Email: strings.ToLower(m[2]), Sender: sender}
+	}
+
+	return nil
+}
+
+type logStatKey struct {
+	Day           string
+	DomainID      int
+	AddressID     int
+}
+
+type logRejectKey struct {
+	Day           string
+	DomainID      int
+	Sender        string
+}
+
+// LogApply adds events to the statistics. Events for domains we
+// don't manage are dropped.
+func LogApply(events []LogEvent, tx *gorm.DB) error {
+	domains := make(map[string]*Domain)
+	addresses := make(map[string]*Address)
+	stats := make(map[logStatKey]*MailStat)
+	rejects := make(map[logRejectKey]int)
+	logins := make(map[int]LogEvent)
+
+	for _, event := range events {
+		at := strings.LastIndex(event.Email, "@")
+		if at < 0 {
+			continue
+		}
+		domain_name := event.Email[at+1:]
+		domain, ok := domains[domain_name]
+		if !ok {
+			domain = DomainFindByName(domain_name, tx)
+			domains[domain_name] = domain
+		}
+		if domain == nil {
+			continue
+		}
+		address, ok := addresses[event.Email]
+		if !ok {
+			address = AddressFindByEmail(event.Email, tx)
+			addresses[event.Email] = address
+		}
+		address_id := 0
+		if address != nil {
+			address_id = address.ID
+		}
+
+		if event.Kind == LOG_LOGIN {
+			if address_id != 0 && event.At.After(logins[address_id].At) {
+				logins[address_id] = event
+			}
+			continue
+		}
+
+		day := event.At.Format("2006-01-02")
+		key := logStatKey{day, domain.ID, address_id}
+		stat, ok := stats[key]
+		if !ok {
+			stat = &MailStat{Day: day, DomainID: domain.ID, AddressID: address_id}
+			stats[key] = stat
+		}
+		switch event.Kind {
+		case LOG_RECEIVED:
+			stat.Received++
+		case LOG_SENT:
+			stat.Sent++
+		case LOG_BOUNCED:
+			stat.Bounced++
+		case LOG_REJECTED:
+			stat.Rejected++
+			rejects[logRejectKey{day, domain.ID, event.Sender}]++
+		}
+	}
+
+	for _, stat := range stats {
+		row := MailStat{}
+		err := tx.Where("day = ? AND domain_id = ? AND address_id = ?", stat.Day, stat.DomainID, stat.AddressID).First(&row).Error
+		if gorm.IsRecordNotFoundError(err) {
+			if err := tx.Create(stat).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&row).UpdateColumns(map[string]interface{}{
+			"received": gorm.Expr("received + ?", stat.Received),
+			"sent":     gorm.Expr("sent + ?", stat.Sent),
+			"bounced":  gorm.Expr("bounced + ?", stat.Bounced),
+			"rejected": gorm.Expr("rejected + ?", stat.Rejected),
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	for key, count := range rejects {
+		row := MailReject{}
+		err := tx.Where("day = ? AND domain_id = ? AND sender = ?", key.Day, key.DomainID, key.Sender).First(&row).Error
+		if gorm.IsRecordNotFoundError(err) {
+			row = MailReject{Day: key.Day, DomainID: key.DomainID, Sender: key.Sender, Count: count}
+			if err := tx.Create(&row).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&row).UpdateColumn("count", gorm.Expr("count + ?", count)).Error; err != nil {
+			return err
+		}
+	}
+
+	for address_id, event := range logins {
+		row := MailLogin{}
+		err := tx.Where("address_id = ?", address_id).First(&row).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		if !row.LoginAt.Before(event.At) {
+			continue
+		}
+		row = MailLogin{AddressID: address_id, LoginAt: event.At, Protocol: event.Protocol, RemoteIP: event.RemoteIP}
+		if err := tx.Save(&row).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LogImport reads path from where the last import stopped. A file
+// smaller than that position has been rotated and is read again.
+// Only complete lines are consumed, so a file can be tailed.
+func LogImport(path string, parser *LogParser, db *gorm.DB) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	state := MailLogFile{}
+	if err := db.Where("path = ?", path).First(&state).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		return 0, err
+	}
+	state.Path = path
+	if info, err := file.Stat(); err == nil && info.Size() < state.Offset {
+		log.Printf("INFO  LogImport: %s was rotated", path)
+		state.Offset = 0
+	}
+	if _, err := file.Seek(state.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	events := []LogEvent{}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		state.Offset += int64(len(line))
+		if event := parser.Parse(strings.TrimRight(line, "\r\n")); event != nil {
+			events = append(events, *event)
+		}
+	}
+
+	tx := db.Begin()
+	if err := LogApply(events, tx); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Save(&state).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return len(events), tx.Commit().Error
+}
+
+func LogInit() {
+	if Log_Interval > 0 && len(Log_Files) > 0 {
+		go LogTailer()
+	}
+}
+
+func LogTailer() {
+	for {
+		db := OpenDB(nil, false)
+		for _, path := range Log_Files {
+			if count, err := LogImport(path, Log_Parser, db); err != nil {
+				log.Printf("ERROR LogTailer %s: %s", path, err)
+			} else if count > 0 && Verbose {
+				log.Printf("DEBUG LogTailer %s: %d events", path, count)
+			}
+		}
+		CloseDB(db)
+
+		time.Sleep(time.Duration(Log_Interval) * time.Second)
+	}
+}
+
+func LogsCommand(args []string) int {
+	if len(args) == 0 || args[0] != "import" {
+		fmt.Fprintf(os.Stderr, "usage: postfix-go logs import [-dry-run] [file ...]\n")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("logs import", flag.ExitOnError)
+	dry_run := flags.Bool("dry-run", false, "print the events instead of storing them")
+	flags.Parse(args[1:])
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = Log_Files
+	}
+
+	if *dry_run {
+		parser := NewLogParser()
+		for _, path := range files {
+			file, err := os.Open(path)
+			if err != nil {
+				log.Printf("ERROR Logs: %s", err)
+				return 1
+			}
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				if event := parser.Parse(scanner.Text()); event != nil {
+					fmt.Printf("%s %-8s %-40s %s%s %s\n", event.At.Format(time.RFC3339), event.Kind, event.Email, event.Sender, event.Protocol, event.RemoteIP)
+				}
+			}
+			file.Close()
+		}
+		return 0
+	}
+
+	db := OpenDB(nil, false)
+	defer CloseDB(db)
+
+	parser := NewLogParser()
+	for _, path := range files {
+		count, err := LogImport(path, parser, db)
+		if err != nil {
+			log.Printf("ERROR Logs %s: %s", path, err)
+			return 1
+		}
+		log.Printf("INFO  Logs %s: %d events", path, count)
+	}
+
+	return 0
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"os"
+	"time"
+	"bufio"
+	"strings"
+	"testing"
+	"path/filepath"
+	"github.com/jinzhu/gorm"
+)
+
+// logTestDB migrates a fresh SQLite database with example.com
+// and its mailbox info@example.com. Other recipients of the
+// domain have no mailbox.
+func logTestDB(t *testing.T) (*gorm.DB, int, int) {
+	DB_Type    = "sqlite3"
+	DB_Connect = filepath.Join(t.TempDir(), "postfix-go.sql")
+	DB_ConnStr = DB_Connect + "?_busy_timeout=5000"
+	DBInit()
+
+	db := OpenDB(nil, false)
+	t.Cleanup(func() {
+		CloseDB(db)
+		Database.Close()
+	})
+	if err := MigrateUp(db); err != nil {
+		t.Fatalf("MigrateUp: %s", err)
+	}
+
+	domain := &Domain{Name: "example.com", DomainType: DOMAIN_MAILBOX}
+	if err := db.Create(domain).Error; err != nil {
+		t.Fatalf("Create domain: %s", err)
+	}
+	address := &Address{Email: "info@example.com", LocalPart: "info", DomainName: domain.Name, DomainID: domain.ID}
+	if err := db.Create(address).Error; err != nil {
+		t.Fatalf("Create address: %s", err)
+	}
+	return db, domain.ID, address.ID
+}
+
+func logTestParse(t *testing.T, path string) []LogEvent {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	parser := NewLogParser()
+	parser.Now = time.Date(2026, 3, 15, 12, 0, 0, 0, time.Local)
+	events := []LogEvent{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if event := parser.Parse(scanner.Text()); event != nil {
+			events = append(events, *event)
+		}
+	}
+	return events
+}
+
+func TestLogParse(t *testing.T) {
+	local := func(hour, min, sec int) time.Time {
+		return time.Date(2026, 3, 14, hour, min, sec, 0, time.Local)
+	}
+	cet := time.FixedZone("", 3600)
+
+	tests := []struct {
+		file   string
+		events []LogEvent
+	}{
+		{"syslog.log", []LogEvent{
+			{At: local(7, 58, 40), Kind: LOG_LOGIN, Email: "info@example.com", Protocol: "imap", RemoteIP: "192.0.2.10"},
+			{At: local(8, 1, 13), Kind: LOG_RECEIVED, Email: "info@example.com", Sender: "alice@gmail.com"},
+			{At: local(8, 1, 13), Kind: LOG_RECEIVED, Email: "sales@example.com", Sender: "alice@gmail.com"},
+			{At: local(9, 15, 2), Kind: LOG_SENT, Email: "info@example.com"},
+			{At: local(9, 15, 3), Kind: LOG_RECEIVED, Email: "sales@example.com", Sender: "info@example.com"},
+			{At: local(10, 42, 51), Kind: LOG_SENT, Email: "info@example.com"},
+			{At: local(10, 42, 52), Kind: LOG_BOUNCED, Email: "info@example.com", Sender: "info@example.com"},
+			{At: local(10, 42, 52), Kind: LOG_RECEIVED, Email: "info@example.com", Sender: ""},
+			{At: local(11, 3, 27), Kind: LOG_REJECTED, Email: "info@example.com", Sender: "promo@spammer.test"},
+			{At: local(11, 3, 29), Kind: LOG_REJECTED, Email: "nobody@example.com", Sender: "promo@spammer.test"},
+			{At: local(11, 4, 10), Kind: LOG_REJECTED, Email: "x@foreign.test", Sender: "a@b.test"},
+			{At: local(12, 30, 5), Kind: LOG_LOGIN, Email: "info@example.com", Protocol: "pop3", RemoteIP: "2001:db8::5"},
+		}},
+		{"iso.log", []LogEvent{
+			{At: time.Date(2026, 3, 14, 8, 1, 13, 601220000, cet), Kind: LOG_RECEIVED, Email: "info@example.com", Sender: "alice@gmail.com"},
+			{At: time.Date(2026, 3, 14, 22, 59, 59, 0, time.UTC), Kind: LOG_LOGIN, Email: "info@example.com", Protocol: "imap", RemoteIP: "192.0.2.10"},
+		}},
+	}
+
+	for _, test := range tests {
+		events := logTestParse(t, filepath.Join("testdata", "maillog", test.file))
+		if len(events) != len(test.events) {
+			t.Errorf("%s: %d events, want %d: %+v", test.file, len(events), len(test.events), events)
+			continue
+		}
+		for index, want := range test.events {
+			got := events[index]
+			if !got.At.Equal(want.At) {
+				t.Errorf("%s #%d: at %s, want %s", test.file, index, got.At, want.At)
+			}
+			got.At, want.At = time.Time{}, time.Time{}
+			if got != want {
+				t.Errorf("%s #%d: %+v, want %+v", test.file, index, got, want)
+			}
+		}
+	}
+}
+
+func TestLogParseYear(t *testing.T) {
+	tests := []struct {
+		now  time.Time
+		year int
+	}{
+		{time.Date(2026, 1, 1, 0, 5, 0, 0, time.Local), 2025},
+		{time.Date(2026, 12, 31, 0, 5, 0, 0, time.Local), 2026},
+	}
+
+	line := "Dec 31 23:59:58 mx1 postfix/smtpd[1]: 4Fz8Lq1VbQz9sWB: client=unknown[192.0.2.10], sasl_method=PLAIN, sasl_username=info@example.com"
+	for _, test := range tests {
+		parser := NewLogParser()
+		parser.Now = test.now
+		event := parser.Parse(line)
+		if event == nil {
+			t.Fatalf("no event for %q", line)
+		}
+		if event.At.Year() != test.year {
+			t.Errorf("read on %s: year %d, want %d", test.now.Format("2006-01-02"), event.At.Year(), test.year)
+		}
+	}
+}
+
+func TestLogApply(t *testing.T) {
+	db, domain_id, info_id := logTestDB(t)
+	events := logTestParse(t, filepath.Join("testdata", "maillog", "syslog.log"))
+
+	tests := []struct {
+		address_id int
+		want       MailStat
+	}{
+		{info_id, MailStat{Received: 2, Sent: 2, Bounced: 1, Rejected: 1}},
+		{0,       MailStat{Received: 2, Rejected: 1}},
+	}
+
+	// The second run adds to the rows of the first one
+	for run := 1; run <= 2; run++ {
+		tx := db.Begin()
+		if err := LogApply(events, tx); err != nil {
+			tx.Rollback()
+			t.Fatalf("LogApply: %s", err)
+		}
+		tx.Commit()
+
+		count := 0
+		db.Model(&MailStat{}).Count(&count)
+		if count != len(tests) {
+			t.Errorf("run %d: %d mail_stats rows, want %d", run, count, len(tests))
+		}
+		for _, test := range tests {
+			stat := MailStat{}
+			if err := db.Where("day = ? AND domain_id = ? AND address_id = ?", "2026-03-14", domain_id, test.address_id).First(&stat).Error; err != nil {
+				t.Errorf("run %d: address %d: %s", run, test.address_id, err)
+				continue
+			}
+			if stat.Received != run * test.want.Received || stat.Sent != run * test.want.Sent ||
+				stat.Bounced != run * test.want.Bounced || stat.Rejected != run * test.want.Rejected {
+				t.Errorf("run %d: address %d: %+v, want %d times %+v", run, test.address_id, stat, run, test.want)
+			}
+		}
+
+		rejects := []MailReject{}
+		db.Find(&rejects)
+		if len(rejects) != 1 || rejects[0].Sender != "promo@spammer.test" || rejects[0].Count != run * 2 {
+			t.Errorf("run %d: rejects %+v", run, rejects)
+		}
+	}
+
+	login := MailLogin{}
+	if err := db.Where("address_id = ?", info_id).First(&login).Error; err != nil {
+		t.Fatalf("no login for info: %s", err)
+	}
+	if login.Protocol != "pop3" || login.RemoteIP != "2001:db8::5" {
+		t.Errorf("login %+v, want the latest one by pop3", login)
+	}
+
+	// An older login doesn't replace the stored one
+	older := []LogEvent{{At: login.LoginAt.Add(-time.Hour), Kind: LOG_LOGIN, Email: "info@example.com", Protocol: "imap", RemoteIP: "192.0.2.99"}}
+	if err := LogApply(older, db); err != nil {
+		t.Fatalf("LogApply: %s", err)
+	}
+	db.Where("address_id = ?", info_id).First(&login)
+	if login.RemoteIP != "2001:db8::5" {
+		t.Errorf("older login stored: %+v", login)
+	}
+}
+
+func TestLogImport(t *testing.T) {
+	db, _, _ := logTestDB(t)
+	path := filepath.Join(t.TempDir(), "mail.log")
+	syslog, err := os.ReadFile(filepath.Join("testdata", "maillog", "syslog.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iso, err := os.ReadFile(filepath.Join("testdata", "maillog", "iso.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(syslog), "\n")
+	sasl := lines[9]
+	partial := sasl[:40]
+
+	appendFile := func(text string) {
+		file, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(text)
+		file.Close()
+	}
+
+	parser := NewLogParser()
+	parser.Now = time.Date(2026, 3, 15, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name   string
+		change func()
+		count  int
+		offset int64
+	}{
+		{"first read", func() { appendFile(string(syslog)) }, 12, int64(len(syslog))},
+		{"nothing new", func() {}, 0, int64(len(syslog))},
+		{"partial line waits", func() { appendFile(partial) }, 0, int64(len(syslog))},
+		{"line completed", func() { appendFile(sasl[40:]) }, 1, int64(len(syslog) + len(sasl))},
+		{"rotated", func() { os.WriteFile(path, iso, 0600) }, 2, int64(len(iso))},
+	}
+
+	for _, test := range tests {
+		test.change()
+		count, err := LogImport(path, parser, db)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if count != test.count {
+			t.Errorf("%s: %d events, want %d", test.name, count, test.count)
+		}
+		state := MailLogFile{}
+		if err := db.Where("path = ?", path).First(&state).Error; err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if state.Offset != test.offset {
+			t.Errorf("%s: offset %d, want %d", test.name, state.Offset, test.offset)
+		}
+	}
+
+	if _, err := LogImport(filepath.Join(t.TempDir(), "missing.log"), parser, db); err == nil {
+		t.Errorf("no error for a missing file")
+	}
+}
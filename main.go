@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"time"
-	"sync"
+	"context"
+	"database/sql"
+	"strings"
 	"net/http"
 	"html/template"
 	"encoding/base64"
@@ -14,8 +16,10 @@ import (
 	"github.com/gorilla/csrf"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/nicksnyder/go-i18n/i18n"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+	"github.com/lib/pq"
 	"github.com/spf13/viper"
 )
 
@@ -27,6 +31,7 @@ const (
 type Context struct {
 	Title          string
 	Language       string
+	Languages      []LanguageOption
 	CsrfField      template.HTML
 	Base_URL       string
 	Flash          string
@@ -38,6 +43,32 @@ type Context struct {
 	Address        *Address
 	Aliases        []Alias
 	Alias          *Alias
+	DnsRecords     []DnsRecord
+	Zone           string
+	ImportRows     []ImportRow
+	ImportData     string
+	ImportFormat   string
+	ImportOK       bool
+	CheckIssues    []CheckIssue
+	MailQueue      []QueuedMail
+	MailTransport  string
+	MailCatcher    bool
+	CaughtMails    []CaughtMail
+	CaughtMail     *CaughtMail
+	NoticeKinds    []string
+	Notices        []Notice
+	Notice         *Notice
+	NoticeOwn      bool
+	NoticePreview  *NoticePreview
+	NoticeError    string
+	HookFailures   []HookFailure
+	WebhookTargets []WebhookTarget
+	WebhookDeliveries []WebhookDelivery
+	Stats          *StatsRow
+	StatsDays      int
+	StatsDomains   []StatsRow
+	StatsAddresses []StatsRow
+	StatsRejects   []StatsReject
 }
 
 var (
@@ -45,6 +76,10 @@ var (
 	DB_Type       string
 	DB_Connect    string
 	DB_ConnStr    string
+	DB_MaxOpen    int
+	DB_MaxIdle    int
+	DB_MaxLifetime int
+	DB_Timeout    int
 	Web_Addr      string
 	Web_Token     string
 	Base_URL      string
@@ -55,12 +90,66 @@ var (
 	SMTP_Port     int
 	SMTP_Username string
 	SMTP_Password string
+	MX_Host       string
+	Web_Host      string
+	DNS_Resolver  string
+	DNS_Interval  int
+	DKIM_Selector string
+	DKIM_PubKey   string
+	DMARC_Policy  string
+	STS_Mode      string
+	STS_MaxAge    int
+	IMAP_Host     string
+	IMAP_Port     int
+	IMAP_Security string
+	Submit_Host   string
+	Submit_Port   int
+	Submit_Security string
+	Mail_Root     string
+	Policy_Addr   string
+	Policy_Window int
+	Policy_Messages int
+	Policy_Recipients int
+	Policy_Suspend int
+	Log_Files     []string
+	Log_Interval  int
+	Stats_Days    int
+	Letter_Logo   string
+	Letter_Sender []string
+	Letter_QR     bool
+	Letter_Batch  int
+	Mail_Transport string
+	Mail_Sendmail string
+	Mail_Spool    string
+	Mail_Workers  int
+	Mail_Interval int
+	Mail_Retries  int
+	Mail_Backoff  int
+	Mail_UID      int
+	Mail_GID      int
+	Onboard_Actions []string
+	Onboard_Folders []string
+	Onboard_Sieve string
+	Hook_Create   []string
+	Hook_Rename   []string
+	Hook_Move     []string
+	Hook_Delete   []string
+	Hook_Archive  string
+	Hook_Timeout  int
+	Webhooks      []WebhookTarget
+	Webhook_Workers int
+	Webhook_Interval int
+	Webhook_Retries int
+	Webhook_Backoff int
+	Webhook_Timeout int
+	Webhook_Keep  int
+	Metrics_Addr  string
+	Metrics_Token string
 	ProdMode      bool
 	Verbose       bool
 	Templates     *template.Template
-	Database      *gorm.DB
+	Database      *sql.DB
 	CookiePrefix  = "postfix_go_"
-	DB_Mutex      = &sync.Mutex{}
 )
 
 func main() {
@@ -79,6 +168,10 @@ func main() {
 	viper.SetDefault("DB_Type",       "sqlite3")
 	viper.SetDefault("Web_Addr",      ":8000")
 	viper.SetDefault("DB_Connect",    "postfix-go.sql")
+	viper.SetDefault("DB_MaxOpen",    10)
+	viper.SetDefault("DB_MaxIdle",    5)
+	viper.SetDefault("DB_MaxLifetime", 60)	// minutes
+	viper.SetDefault("DB_Timeout",    10)	// seconds per request
 	viper.SetDefault("Web_Token",     "_Postfix_Dovecot_Golang_PureCSS_")	// 32 bytes
 	viper.SetDefault("Base_URL",      "/")
 	viper.SetDefault("TLS_Cert",      "")
@@ -88,6 +181,60 @@ func main() {
 	viper.SetDefault("SMTP_Port",     587)
 	viper.SetDefault("SMTP_Username", "relay_user")
 	viper.SetDefault("SMTP_Password", "relay_pswd")
+	viper.SetDefault("MX_Host",       "mail.example.com")
+	viper.SetDefault("Web_Host",      "mail.example.com")
+	viper.SetDefault("DNS_Resolver",  "")	// host:port, empty for system
+	viper.SetDefault("DNS_Interval",  60)	// minutes, 0 to disable
+	viper.SetDefault("DKIM_Selector", "mail")
+	viper.SetDefault("DKIM_PubKey",   "")
+	viper.SetDefault("DMARC_Policy",  "none")
+	viper.SetDefault("STS_Mode",      "testing")
+	viper.SetDefault("STS_MaxAge",    86400)
+	viper.SetDefault("IMAP_Host",     "mail.example.com")
+	viper.SetDefault("IMAP_Port",     993)
+	viper.SetDefault("IMAP_Security", "SSL")	// SSL, STARTTLS or plain
+	viper.SetDefault("Submit_Host",   "mail.example.com")
+	viper.SetDefault("Submit_Port",   587)
+	viper.SetDefault("Submit_Security", "STARTTLS")
+	viper.SetDefault("Mail_Root",     "/var/vmail")
+	viper.SetDefault("Policy_Addr",   "")	// e.g. 127.0.0.1:10040, empty to disable
+	viper.SetDefault("Policy_Window", 60)	// minutes
+	viper.SetDefault("Policy_Messages", 100)	// per address and window, 0 for no limit
+	viper.SetDefault("Policy_Recipients", 500)
+	viper.SetDefault("Policy_Suspend", 3)	// suspend at this multiple of a limit, 0 to never
+	viper.SetDefault("Log_Files",     []string{})	// e.g. /var/log/mail.log
+	viper.SetDefault("Log_Interval",  60)	// seconds, 0 to disable
+	viper.SetDefault("Stats_Days",    30)
+	viper.SetDefault("Letter_Logo",   "static/img/Logo.png")	// empty for none
+	viper.SetDefault("Letter_Sender", []string{})	// lines of the sender address
+	viper.SetDefault("Letter_QR",     true)
+	viper.SetDefault("Letter_Batch",  50)	// addresses per PDF, bcrypt must finish within the write timeout
+	viper.SetDefault("Mail_Transport", "smtp")	// smtp, sendmail, maildir or catcher
+	viper.SetDefault("Mail_Sendmail", "/usr/sbin/sendmail")
+	viper.SetDefault("Mail_Spool",    "mail-spool")	// maildir for development
+	viper.SetDefault("Mail_Workers",  2)
+	viper.SetDefault("Mail_Interval", 30)	// seconds
+	viper.SetDefault("Mail_Retries",  10)
+	viper.SetDefault("Mail_Backoff",  60)	// seconds, doubled per attempt
+	viper.SetDefault("Mail_UID",      0)	// owner of the mailbox files, 0 to leave as is
+	viper.SetDefault("Mail_GID",      0)
+	viper.SetDefault("Onboard_Actions", []string{"welcome", "password"})	// and sieve, which includes the maildir hook
+	viper.SetDefault("Onboard_Folders", []string{"Drafts", "Sent", "Trash", "Junk"})
+	viper.SetDefault("Onboard_Sieve", "")	// script template, empty for the built-in one
+	viper.SetDefault("Hook_Create",   []string{})	// built-in maildir, rename, archive or shell commands
+	viper.SetDefault("Hook_Rename",   []string{})	// e.g. [rename]
+	viper.SetDefault("Hook_Move",     []string{})	// e.g. [rename]
+	viper.SetDefault("Hook_Delete",   []string{})	// e.g. [archive]
+	viper.SetDefault("Hook_Archive",  "/var/vmail-archive")
+	viper.SetDefault("Hook_Timeout",  60)	// seconds per command
+	viper.SetDefault("Webhook_Workers", 2)
+	viper.SetDefault("Webhook_Interval", 30)	// seconds
+	viper.SetDefault("Webhook_Retries", 8)
+	viper.SetDefault("Webhook_Backoff", 60)	// seconds, doubled per attempt
+	viper.SetDefault("Webhook_Timeout", 10)	// seconds per request
+	viper.SetDefault("Webhook_Keep",  30)	// days in the delivery log
+	viper.SetDefault("Metrics_Addr",  "")	// e.g. 127.0.0.1:9100, empty to disable
+	viper.SetDefault("Metrics_Token", "")	// bearer token, empty for none
 	viper.SetDefault("ProdMode",      false)
 	viper.SetDefault("Verbose",       true)
 
@@ -99,6 +246,10 @@ func main() {
 	Language      = viper.GetString("Language")
 	DB_Type       = viper.GetString("DB_Type")
 	DB_Connect    = viper.GetString("DB_Connect")
+	DB_MaxOpen    = viper.GetInt("DB_MaxOpen")
+	DB_MaxIdle    = viper.GetInt("DB_MaxIdle")
+	DB_MaxLifetime = viper.GetInt("DB_MaxLifetime")
+	DB_Timeout    = viper.GetInt("DB_Timeout")
 	Web_Addr      = viper.GetString("Web_Addr")
 	Web_Token     = viper.GetString("Web_Token")
 	Base_URL      = viper.GetString("Base_URL")
@@ -109,11 +260,72 @@ func main() {
 	SMTP_Port     = viper.GetInt("SMTP_Port")
 	SMTP_Username = viper.GetString("SMTP_Username")
 	SMTP_Password = viper.GetString("SMTP_Password")
+	MX_Host       = viper.GetString("MX_Host")
+	Web_Host      = viper.GetString("Web_Host")
+	DNS_Resolver  = viper.GetString("DNS_Resolver")
+	DNS_Interval  = viper.GetInt("DNS_Interval")
+	DKIM_Selector = viper.GetString("DKIM_Selector")
+	DKIM_PubKey   = viper.GetString("DKIM_PubKey")
+	DMARC_Policy  = viper.GetString("DMARC_Policy")
+	STS_Mode      = viper.GetString("STS_Mode")
+	STS_MaxAge    = viper.GetInt("STS_MaxAge")
+	IMAP_Host     = viper.GetString("IMAP_Host")
+	IMAP_Port     = viper.GetInt("IMAP_Port")
+	IMAP_Security = viper.GetString("IMAP_Security")
+	Submit_Host   = viper.GetString("Submit_Host")
+	Submit_Port   = viper.GetInt("Submit_Port")
+	Submit_Security = viper.GetString("Submit_Security")
+	Mail_Root     = viper.GetString("Mail_Root")
+	Policy_Addr   = viper.GetString("Policy_Addr")
+	Policy_Window = viper.GetInt("Policy_Window")
+	Policy_Messages = viper.GetInt("Policy_Messages")
+	Policy_Recipients = viper.GetInt("Policy_Recipients")
+	Policy_Suspend = viper.GetInt("Policy_Suspend")
+	Log_Files     = viper.GetStringSlice("Log_Files")
+	Log_Interval  = viper.GetInt("Log_Interval")
+	Stats_Days    = viper.GetInt("Stats_Days")
+	Letter_Logo   = viper.GetString("Letter_Logo")
+	Letter_Sender = viper.GetStringSlice("Letter_Sender")
+	Letter_QR     = viper.GetBool("Letter_QR")
+	Letter_Batch  = viper.GetInt("Letter_Batch")
+	Mail_Transport = viper.GetString("Mail_Transport")
+	Mail_Sendmail = viper.GetString("Mail_Sendmail")
+	Mail_Spool    = viper.GetString("Mail_Spool")
+	Mail_Workers  = viper.GetInt("Mail_Workers")
+	Mail_Interval = viper.GetInt("Mail_Interval")
+	Mail_Retries  = viper.GetInt("Mail_Retries")
+	Mail_Backoff  = viper.GetInt("Mail_Backoff")
+	Mail_UID      = viper.GetInt("Mail_UID")
+	Mail_GID      = viper.GetInt("Mail_GID")
+	Onboard_Actions = viper.GetStringSlice("Onboard_Actions")
+	Onboard_Folders = viper.GetStringSlice("Onboard_Folders")
+	Onboard_Sieve = viper.GetString("Onboard_Sieve")
+	Hook_Create   = viper.GetStringSlice("Hook_Create")
+	Hook_Rename   = viper.GetStringSlice("Hook_Rename")
+	Hook_Move     = viper.GetStringSlice("Hook_Move")
+	Hook_Delete   = viper.GetStringSlice("Hook_Delete")
+	Hook_Archive  = viper.GetString("Hook_Archive")
+	Hook_Timeout  = viper.GetInt("Hook_Timeout")
+	Webhook_Workers = viper.GetInt("Webhook_Workers")
+	Webhook_Interval = viper.GetInt("Webhook_Interval")
+	Webhook_Retries = viper.GetInt("Webhook_Retries")
+	Webhook_Backoff = viper.GetInt("Webhook_Backoff")
+	Webhook_Timeout = viper.GetInt("Webhook_Timeout")
+	Webhook_Keep  = viper.GetInt("Webhook_Keep")
+	Metrics_Addr  = viper.GetString("Metrics_Addr")
+	Metrics_Token = viper.GetString("Metrics_Token")
+	if err := viper.UnmarshalKey("Webhooks", &Webhooks); err != nil {
+		log.Printf("FATAL Webhooks: %s", err)
+		os.Exit(1)
+	}
 	ProdMode      = viper.GetBool("ProdMode")
 	Verbose       = viper.GetBool("Verbose")
 
 	if DB_Type == "mysql" {
 		DB_ConnStr = DB_Connect + "?charset=utf8&parseTime=True&loc=Local"
+	} else if DB_Type == "sqlite3" && !strings.Contains(DB_Connect, "?") {
+		// WAL lets readers run while a writer is busy
+		DB_ConnStr = DB_Connect + "?_journal_mode=WAL&_busy_timeout=5000"
 	} else {
 		DB_ConnStr = DB_Connect
 	}
@@ -125,70 +337,132 @@ func main() {
 		log.Printf("DEBUG Base_URL ............ %s",      Base_URL)
 		log.Printf("DEBUG SMTP-Host:Port ...... %s:%d",   SMTP_Host, SMTP_Port)
 		log.Printf("DEBUG SMTP-Login .......... %s / %s", SMTP_Username, SMTP_Password)
+		log.Printf("DEBUG MX-Host / Web-Host .. %s / %s", MX_Host, Web_Host)
 	}
 
 	//
 	// Setup i18n
 	//
-	langfile := fmt.Sprintf("locales/%s.all.json", Language)
-	if err := i18n.LoadTranslationFile(langfile); err != nil {
+	if err := LanguageInit(); err != nil {
 		log.Printf("FATAL Language %s: %s", Language, err)
 		os.Exit(1)
 	}
 
+	//
+	// Setup the database connection pool
+	//
+	DBInit()
+
+	//
+	// Run a command instead of the web server
+	//
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(RunCommand(os.Args[1], os.Args[2:]))
+	}
+
 	//
 	// Initialize Database Tables (AddressInit must be last)
 	//
+	MigrateCheck()
 	DomainInit()
 	AliasInit()
 	AddressInit()
 
 	//
-	// Initialize templates and function map
+	// Start the DNS health check
 	//
-	funcMap := template.FuncMap{
-		"safe": func(s string) template.HTML {
-			return template.HTML(s)
-		},
-		"T": func(s string) string {
-			t, _ := i18n.Tfunc(Language)
-			return t(s)
-		},
-		"time": func(tm time.Time) string {
-			t, _ := i18n.Tfunc(Language)
-			return tm.Format(t("date_time"))
-		},
-	}
-	Templates = template.Must(template.New("").Funcs(funcMap).ParseGlob("templates/*"))
+	DnsInit()
+
+	//
+	// Start sending queued mail
+	//
+	MailInit()
+
+	//
+	// Start delivering webhooks
+	//
+	WebhookInit()
+
+	//
+	// Start the metrics endpoint
+	//
+	MetricsInit()
+
+	//
+	// Start the policy delegation server
+	//
+	PolicyInit()
+
+	//
+	// Start reading the mail logs
+	//
+	LogInit()
+
+	//
+	// Initialize templates, one set per language
+	//
+	LanguageTemplatesInit()
 
 	//
 	// Setup the web server and router
 	//
-	r := httprouter.New()
+	r := Router{httprouter.New()}
 
 	r.ServeFiles(Base_URL + "static/*filepath", http.Dir("static"))
+	r.GET("/.well-known/mta-sts.txt",      MtaStsServe)
+	r.GET("/.well-known/autoconfig/mail/config-v1.1.xml", AutoconfigThunderbird)
+	r.GET("/mail/config-v1.1.xml",         AutoconfigThunderbird)
+	r.POST("/autodiscover/autodiscover.xml", AutoconfigAutodiscover)
+	r.POST("/Autodiscover/Autodiscover.xml", AutoconfigAutodiscover)
 
 	r.GET(Base_URL,                        HomeIndex)
+	r.GET(Base_URL + "addresses",          HomeAddresses)
 	r.GET(Base_URL + "login",              LoginLoginGet)
 	r.GET(Base_URL + "logout",             LoginLogout)
 	r.GET(Base_URL + "help/:page",         HelpShow)
+	r.GET(Base_URL + "language/:lang",     LanguageSwitch)
 	r.GET(Base_URL + "domain",             DomainCreate)
 	r.GET(Base_URL + "domain/:id",         DomainEdit)
 	r.GET(Base_URL + "domain/:id/delete",  DomainDelete)
+	r.GET(Base_URL + "domain/:id/dns",     DomainDns)
+	r.GET(Base_URL + "domain/:id/mta-sts", MtaStsDownload)
+	r.GET(Base_URL + "domain/:id/letters", DomainLetters)
 	r.GET(Base_URL + "address",            AddressCreate)
 	r.GET(Base_URL + "address/:id",        AddressEdit)
 	r.GET(Base_URL + "address/:id/print",  AddressPrint)
+	r.GET(Base_URL + "address/:id/mobileconfig", AutoconfigMobileconfig)
 	r.GET(Base_URL + "address/:id/delete", AddressDelete)
 	r.GET(Base_URL + "password",           PasswordEdit)
+	r.GET(Base_URL + "import",             ImportForm)
+	r.GET(Base_URL + "export",             Export)
+	r.GET(Base_URL + "check",              CheckShow)
+	r.GET(Base_URL + "outbox",             MailShow)
+	r.GET(Base_URL + "outbox/:id/delete",  MailDelete)
+	r.GET(Base_URL + "catcher",            CatcherList)
+	r.GET(Base_URL + "catcher/:id",        CatcherShow)
+	r.GET(Base_URL + "stats",              StatsShow)
+	r.GET(Base_URL + "notices",            NoticeList)
+	r.GET(Base_URL + "notice",             NoticeEdit)
+	r.GET(Base_URL + "hooks",              HookShow)
+	r.GET(Base_URL + "hooks/:id/delete",   HookDelete)
+	r.GET(Base_URL + "webhooks",           WebhookShow)
 	r.POST(Base_URL + "login",             LoginLoginPost)
 	r.POST(Base_URL + "domain/:id",        DomainUpdate)
 	r.POST(Base_URL + "address/:id",       AddressUpdate)
 	r.POST(Base_URL + "password",          PasswordUpdate)
+	r.POST(Base_URL + "import",            ImportPost)
+	r.POST(Base_URL + "check",             CheckRepairPost)
+	r.POST(Base_URL + "outbox/:id/retry",  MailRetry)
+	r.POST(Base_URL + "catcher/clear",     CatcherClear)
+	r.POST(Base_URL + "notice",            NoticeUpdate)
+	r.POST(Base_URL + "hooks/:id/retry",   HookRetryPost)
+	r.POST(Base_URL + "webhooks/:id/retry", WebhookRetry)
+	r.POST(Base_URL + "domain/:id/letters", DomainLettersPost)
 	// TODO audit trail
 
 	srv := &http.Server{
 		Addr:         Web_Addr,
-		Handler:      csrf.Protect([]byte(Web_Token), csrf.Secure(ProdMode))(r),
+		Handler:      CsrfExempt(csrf.Protect([]byte(Web_Token), csrf.Secure(ProdMode))(r)),
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
@@ -200,6 +474,30 @@ func main() {
 	}
 }
 
+func RunCommand(name string, args []string) int {
+	switch name {
+	case "backup":
+		return BackupCommand(args)
+	case "restore":
+		return RestoreCommand(args)
+	case "migrate":
+		return MigrateCommand(args)
+	case "check":
+		return CheckCommand(args)
+	case "config":
+		return ConfigCommand(args)
+	case "logs":
+		return LogsCommand(args)
+	case "i18n":
+		return I18nCommand(args)
+	case "webhook":
+		return WebhookCommand(args)
+	}
+
+	fmt.Fprintf(os.Stderr, "usage: postfix-go [backup [file] | restore [-force] file | migrate status|up|down | check [-repair] | config snippets|maps [dir] | logs import [-dry-run] [file ...] | i18n check|skeleton lang | webhook listen]\n")
+	return 2
+}
+
 func RenderHtml(w http.ResponseWriter, r *http.Request, tmpl string, ctx Context) {
 	log.Printf("DEBUG RenderHtml: %s", tmpl)
 
@@ -209,9 +507,11 @@ func RenderHtml(w http.ResponseWriter, r *http.Request, tmpl string, ctx Context
 	}
 
 	ctx.CsrfField = csrf.TemplateField(r)
-	ctx.Language  = Language
+	ctx.Language  = RequestLanguage(r)
+	ctx.Languages = Languages
+	ctx.MailCatcher = Mail_Catcher != nil
 
-	if err := Templates.ExecuteTemplate(w, tmpl, ctx); err != nil {
+	if err := LanguageTemplates(ctx.Language).ExecuteTemplate(w, tmpl, ctx); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -265,27 +565,103 @@ func GetCookie(r *http.Request, name string) string {
 	return ""
 }
 
-func OpenDB(logmode bool) *gorm.DB {
-	DB_Mutex.Lock()
+// DBConn hands every statement to the shared connection pool together
+// with the context of the request it belongs to, so slow statements are
+// cancelled after DB_Timeout. It implements gorm.SQLCommon.
+type DBConn struct {
+	ctx           context.Context
+	cancel        context.CancelFunc
+	db            *sql.DB
+}
 
-	if Database == nil {
-		db, err := gorm.Open(DB_Type, DB_ConnStr)
-		if err != nil {
-			log.Printf("FATAL OpenDB %s: %s", DB_Connect, err)
-			os.Exit(1)
-		}
-		Database = db
+func (c *DBConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.db.ExecContext(c.ctx, query, args...)
+}
+
+func (c *DBConn) Prepare(query string) (*sql.Stmt, error) {
+	return c.db.PrepareContext(c.ctx, query)
+}
+
+func (c *DBConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.QueryContext(c.ctx, query, args...)
+}
+
+func (c *DBConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.db.QueryRowContext(c.ctx, query, args...)
+}
+
+func (c *DBConn) Begin() (*sql.Tx, error) {
+	return c.db.BeginTx(c.ctx, nil)
+}
+
+func (c *DBConn) BeginTx(_ context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return c.db.BeginTx(c.ctx, opts)
+}
+
+func DBInit() {
+	db, err := sql.Open(DB_Type, DB_ConnStr)
+	if err != nil {
+		log.Printf("FATAL DBInit %s: %s", DB_Connect, err)
+		os.Exit(1)
+	}
+	if err := db.Ping(); err != nil {
+		log.Printf("FATAL DBInit %s: %s", DB_Connect, err)
+		os.Exit(1)
+	}
+
+	db.SetMaxOpenConns(DB_MaxOpen)
+	db.SetMaxIdleConns(DB_MaxIdle)
+	db.SetConnMaxLifetime(time.Duration(DB_MaxLifetime) * time.Minute)
+
+	Database = db
+}
+
+// OpenDB returns a handle on the shared pool. Statements run with the
+// context of r (limited to DB_Timeout), or without limit if r is nil.
+// Always pair it with CloseDB.
+func OpenDB(r *http.Request, logmode bool) *gorm.DB {
+	conn := &DBConn{db: Database}
+	if r != nil {
+		conn.ctx, conn.cancel = context.WithTimeout(r.Context(), time.Duration(DB_Timeout) * time.Second)
+	} else {
+		conn.ctx, conn.cancel = context.WithCancel(context.Background())
 	}
-	Database.LogMode(logmode)
 
-	return Database
+	db, err := gorm.Open(DB_Type, conn)
+	if err != nil {
+		log.Printf("FATAL OpenDB %s: %s", DB_Connect, err)
+		os.Exit(1)
+	}
+	db.LogMode(logmode)
+	if r != nil {
+		db = db.Set("language", RequestLanguage(r))
+	}
+
+	return db
 }
 
-func CloseDB() {
-	if Database != nil {
-		Database.Close()
-		Database = nil
+// DBIsUnique tells whether err is a unique constraint violation,
+// independent of the database driver in use.
+func DBIsUnique(err error) bool {
+	switch e := err.(type) {
+	case sqlite3.Error:
+		return e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	case *mysql.MySQLError:
+		return e.Number == 1062	// ER_DUP_ENTRY
+	case *pq.Error:
+		return e.Code == "23505"	// unique_violation
+	case gorm.Errors:
+		for _, err := range e {
+			if DBIsUnique(err) {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	DB_Mutex.Unlock()
+func CloseDB(db *gorm.DB) {
+	if conn, ok := db.CommonDB().(*DBConn); ok {
+		conn.cancel()
+	}
 }
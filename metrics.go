@@ -0,0 +1,262 @@
+package main
+
+import (
+	"os"
+	"net"
+	"log"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"bytes"
+	"net/http"
+	"crypto/subtle"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Upper bounds in seconds for the request latency histogram
+var Metrics_Buckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type MetricsRoute struct {
+	Method        string
+	Route         string
+}
+
+type MetricsRequests struct {
+	Codes         map[int]int64
+	Buckets       []int64
+	Sum           float64
+	Count         int64
+}
+
+var (
+	Metrics_Mutex    sync.Mutex
+	Metrics_Requests = make(map[MetricsRoute]*MetricsRequests)
+	Metrics_Logins   = map[string]int64{"success": 0, "failure": 0}
+	Metrics_Resets   int64
+)
+
+// Router counts the requests per registered route, so the labels
+// stay the route patterns instead of every address ID on its own.
+type Router struct {
+	*httprouter.Router
+}
+
+func (r Router) GET(path string, handle httprouter.Handle) {
+	r.Router.GET(path, MetricsHandle("GET", path, handle))
+}
+
+func (r Router) POST(path string, handle httprouter.Handle) {
+	r.Router.POST(path, MetricsHandle("POST", path, handle))
+}
+
+type metricsWriter struct {
+	http.ResponseWriter
+	code          int
+}
+
+func (w *metricsWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func MetricsHandle(method, path string, handle httprouter.Handle) httprouter.Handle {
+	if Metrics_Addr == "" {
+		return handle
+	}
+	route := MetricsRoute{Method: method, Route: path}
+
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		writer := &metricsWriter{ResponseWriter: w, code: http.StatusOK}
+		handle(writer, r, ps)
+		MetricsRequest(route, writer.code, time.Since(start).Seconds())
+	}
+}
+
+func MetricsRequest(route MetricsRoute, code int, seconds float64) {
+	Metrics_Mutex.Lock()
+	defer Metrics_Mutex.Unlock()
+
+	requests := Metrics_Requests[route]
+	if requests == nil {
+		requests = &MetricsRequests{
+			Codes:   make(map[int]int64),
+			Buckets: make([]int64, len(Metrics_Buckets)),
+		}
+		Metrics_Requests[route] = requests
+	}
+	requests.Codes[code]++
+	for index, bound := range Metrics_Buckets {
+		if seconds <= bound {
+			requests.Buckets[index]++
+		}
+	}
+	requests.Sum += seconds
+	requests.Count++
+}
+
+// MetricsLogin counts a login attempt, result is success or failure.
+func MetricsLogin(result string) {
+	Metrics_Mutex.Lock()
+	defer Metrics_Mutex.Unlock()
+
+	Metrics_Logins[result]++
+}
+
+// MetricsReset counts a reset notice once it is queued, the mail
+// queue sends it later on.
+func MetricsReset() {
+	Metrics_Mutex.Lock()
+	defer Metrics_Mutex.Unlock()
+
+	Metrics_Resets++
+}
+
+// MetricsInit serves /metrics on a listener of its own, so it
+// never shows up below Base_URL. Metrics_Token, if set, has to be
+// sent as a bearer token.
+func MetricsInit() {
+	if Metrics_Addr == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", Metrics_Addr)
+	if err != nil {
+		log.Printf("FATAL MetricsInit: %s", err)
+		os.Exit(1)
+	}
+	log.Printf("INFO  Metrics listening on %s", Metrics_Addr)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", MetricsServe)
+	srv := &http.Server{
+		Handler:      mux,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+
+	go func() {
+		if err := srv.Serve(listener); err != nil {
+			log.Printf("ERROR MetricsInit:Serve: %s", err)
+		}
+	}()
+}
+
+func MetricsServe(w http.ResponseWriter, r *http.Request) {
+	if Metrics_Token != "" {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer " + Metrics_Token)) != 1 {
+			log.Printf("ERROR Metrics: bad token from %s", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	buf := bytes.Buffer{}
+	MetricsWriteRequests(&buf)
+	MetricsWriteCounters(&buf)
+	MetricsWriteDatabase(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func MetricsWriteRequests(buf *bytes.Buffer) {
+	Metrics_Mutex.Lock()
+	defer Metrics_Mutex.Unlock()
+
+	routes := []MetricsRoute{}
+	for route, _ := range Metrics_Requests {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Route != routes[j].Route {
+			return routes[i].Route < routes[j].Route
+		}
+		return routes[i].Method < routes[j].Method
+	})
+
+	fmt.Fprintf(buf, "# HELP postfixgo_http_requests_total Requests handled per route and status code.\n")
+	fmt.Fprintf(buf, "# TYPE postfixgo_http_requests_total counter\n")
+	for _, route := range routes {
+		requests := Metrics_Requests[route]
+		codes := []int{}
+		for code, _ := range requests.Codes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(buf, "postfixgo_http_requests_total{method=%q,route=%q,code=\"%d\"} %d\n",
+				route.Method, route.Route, code, requests.Codes[code])
+		}
+	}
+
+	fmt.Fprintf(buf, "# HELP postfixgo_http_request_duration_seconds Time spent handling requests per route.\n")
+	fmt.Fprintf(buf, "# TYPE postfixgo_http_request_duration_seconds histogram\n")
+	for _, route := range routes {
+		requests := Metrics_Requests[route]
+		labels := fmt.Sprintf("method=%q,route=%q", route.Method, route.Route)
+		for index, bound := range Metrics_Buckets {
+			fmt.Fprintf(buf, "postfixgo_http_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n",
+				labels, bound, requests.Buckets[index])
+		}
+		fmt.Fprintf(buf, "postfixgo_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, requests.Count)
+		fmt.Fprintf(buf, "postfixgo_http_request_duration_seconds_sum{%s} %g\n", labels, requests.Sum)
+		fmt.Fprintf(buf, "postfixgo_http_request_duration_seconds_count{%s} %d\n", labels, requests.Count)
+	}
+}
+
+func MetricsWriteCounters(buf *bytes.Buffer) {
+	Metrics_Mutex.Lock()
+	defer Metrics_Mutex.Unlock()
+
+	fmt.Fprintf(buf, "# HELP postfixgo_logins_total Login attempts by result.\n")
+	fmt.Fprintf(buf, "# TYPE postfixgo_logins_total counter\n")
+	for _, result := range []string{"success", "failure"} {
+		fmt.Fprintf(buf, "postfixgo_logins_total{result=%q} %d\n", result, Metrics_Logins[result])
+	}
+
+	fmt.Fprintf(buf, "# HELP postfixgo_password_resets_queued_total Password reset mails queued.\n")
+	fmt.Fprintf(buf, "# TYPE postfixgo_password_resets_queued_total counter\n")
+	fmt.Fprintf(buf, "postfixgo_password_resets_queued_total %d\n", Metrics_Resets)
+}
+
+// MetricsWriteDatabase reports the connection pool, where requests
+// wait for a free connection, and counts the main tables.
+func MetricsWriteDatabase(buf *bytes.Buffer) {
+	stats := Database.Stats()
+
+	fmt.Fprintf(buf, "# HELP postfixgo_db_connections Database connections by state.\n")
+	fmt.Fprintf(buf, "# TYPE postfixgo_db_connections gauge\n")
+	fmt.Fprintf(buf, "postfixgo_db_connections{state=\"in_use\"} %d\n", stats.InUse)
+	fmt.Fprintf(buf, "postfixgo_db_connections{state=\"idle\"} %d\n", stats.Idle)
+	fmt.Fprintf(buf, "# HELP postfixgo_db_wait_total Times a request had to wait for a database connection.\n")
+	fmt.Fprintf(buf, "# TYPE postfixgo_db_wait_total counter\n")
+	fmt.Fprintf(buf, "postfixgo_db_wait_total %d\n", stats.WaitCount)
+	fmt.Fprintf(buf, "# HELP postfixgo_db_wait_seconds_total Time spent waiting for a database connection.\n")
+	fmt.Fprintf(buf, "# TYPE postfixgo_db_wait_seconds_total counter\n")
+	fmt.Fprintf(buf, "postfixgo_db_wait_seconds_total %g\n", stats.WaitDuration.Seconds())
+
+	db := OpenDB(nil, false)
+	defer CloseDB(db)
+
+	tables := []struct{
+		name  string
+		model interface{}
+	} {
+		{"domains",   &Domain{}},
+		{"addresses", &Address{}},
+		{"aliases",   &Alias{}},
+	}
+	fmt.Fprintf(buf, "# HELP postfixgo_objects Number of domains, addresses and aliases.\n")
+	fmt.Fprintf(buf, "# TYPE postfixgo_objects gauge\n")
+	for _, table := range tables {
+		count := 0
+		if err := db.Model(table.model).Count(&count).Error; err != nil {
+			log.Printf("ERROR Metrics:Count %s: %s", table.name, err)
+			continue
+		}
+		fmt.Fprintf(buf, "postfixgo_objects{type=%q} %d\n", table.name, count)
+	}
+}
@@ -0,0 +1,745 @@
+package main
+
+import (
+	"os"
+	"log"
+	"fmt"
+	"time"
+	"flag"
+	"regexp"
+	"strings"
+	"github.com/jinzhu/gorm"
+)
+
+type Migration struct {
+	Version       int
+	Name          string
+	Up            func(tx *gorm.DB) error
+	Down          func(tx *gorm.DB) error
+}
+
+type SchemaMigration struct {
+	Version       int         `gorm:"primary_key;auto_increment:false"`
+	Name          string
+	AppliedAt     time.Time
+}
+
+// Snapshots of the tables as created by the first migration. Later
+// migrations must never change these, but add steps of their own.
+type domainV1 struct {
+	ID            int         `gorm:"primary_key"`
+	Name          string      `gorm:"unique_index"`
+	CreatedAt     time.Time
+	CreatedBy     int         `gorm:"index"`
+	UpdatedAt     time.Time
+	UpdatedBy     int         `gorm:"index"`
+}
+
+type addressV1 struct {
+	ID            int         `gorm:"primary_key"`
+	Email         string      `gorm:"unique_index"`
+	CreatedAt     time.Time
+	CreatedBy     int         `gorm:"index"`
+	UpdatedAt     time.Time
+	UpdatedBy     int         `gorm:"index"`
+	LocalPart     string      `gorm:"index"`
+	DomainName    string
+	DomainID      int         `gorm:"index"`
+	OtherEmail    string
+	Bcrypt        string
+	Sha512        string
+	Initial       string
+	Admin         bool
+}
+
+type aliasV1 struct {
+	ID            int         `gorm:"primary_key"`
+	Email         string      `gorm:"unique_index"`
+	Destination   string
+	CreatedAt     time.Time
+	CreatedBy     int         `gorm:"index"`
+	UpdatedAt     time.Time
+	UpdatedBy     int         `gorm:"index"`
+	LocalPart     string      `gorm:"index"`
+	DomainName    string
+	DomainID      int         `gorm:"index"`
+	AddressID     int         `gorm:"index"`
+}
+
+type relayRecipientV5 struct {
+	ID            int         `gorm:"primary_key"`
+	DomainID      int         `gorm:"index"`
+	Email         string
+}
+
+type mailStatV7 struct {
+	ID            int         `gorm:"primary_key"`
+	Day           string      `gorm:"index"`
+	DomainID      int         `gorm:"index"`
+	AddressID     int         `gorm:"index"`
+	Received      int
+	Sent          int
+	Bounced       int
+	Rejected      int
+}
+
+type mailRejectV7 struct {
+	ID            int         `gorm:"primary_key"`
+	Day           string      `gorm:"index"`
+	DomainID      int         `gorm:"index"`
+	Sender        string
+	Count         int
+}
+
+type mailLoginV7 struct {
+	AddressID     int         `gorm:"primary_key;auto_increment:false"`
+	LoginAt       time.Time
+	Protocol      string
+	RemoteIP      string
+}
+
+type mailLogFileV7 struct {
+	Path          string      `gorm:"primary_key"`
+	Offset        int64
+	UpdatedAt     time.Time
+}
+
+type mailQueueV9 struct {
+	ID            int         `gorm:"primary_key"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Sender        string
+	Recipients    string      `gorm:"type:text"`
+	Subject       string
+	Body          string      `gorm:"type:text"`
+	Status        string      `gorm:"index"`
+	Attempts      int
+	NextAttempt   time.Time   `gorm:"index"`
+	LastError     string      `gorm:"type:text"`
+}
+
+type noticeV10 struct {
+	ID            int         `gorm:"primary_key"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	UpdatedBy     int
+	DomainID      int         `gorm:"unique_index:idx_notice"`
+	Kind          string      `gorm:"unique_index:idx_notice"`
+	Language      string      `gorm:"unique_index:idx_notice"`
+	Subject       string
+	Text          string      `gorm:"type:text"`
+	HTML          string      `gorm:"type:text"`
+}
+
+type hookFailureV11 struct {
+	ID            int         `gorm:"primary_key"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Event         string
+	Action        string      `gorm:"type:text"`
+	AddressID     int         `gorm:"index"`
+	Email         string
+	OldEmail      string
+	Attempts      int
+	LastError     string      `gorm:"type:text"`
+}
+
+type webhookDeliveryV12 struct {
+	ID            int         `gorm:"primary_key"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Event         string
+	URL           string
+	Payload       string      `gorm:"type:text"`
+	Status        string      `gorm:"index"`
+	Attempts      int
+	NextAttempt   time.Time   `gorm:"index"`
+	ResponseCode  int
+	LastError     string      `gorm:"type:text"`
+}
+
+func (SchemaMigration) TableName() string { return "schema_migrations" }
+func (domainV1) TableName() string        { return "domains" }
+func (addressV1) TableName() string       { return "addresses" }
+func (aliasV1) TableName() string         { return "aliases" }
+func (relayRecipientV5) TableName() string { return "relay_recipients" }
+func (mailStatV7) TableName() string      { return "mail_stats" }
+func (mailRejectV7) TableName() string    { return "mail_rejects" }
+func (mailLoginV7) TableName() string     { return "mail_logins" }
+func (mailLogFileV7) TableName() string   { return "mail_log_files" }
+func (mailQueueV9) TableName() string     { return "mail_queue" }
+func (noticeV10) TableName() string       { return "notices" }
+func (hookFailureV11) TableName() string  { return "hook_failures" }
+func (webhookDeliveryV12) TableName() string { return "webhook_deliveries" }
+
+const (
+	SQL_String  = "VARCHAR(255) NOT NULL DEFAULT ''"
+	SQL_Integer = "INTEGER NOT NULL DEFAULT 0"
+	SQL_Text    = "VARCHAR(4000) NOT NULL DEFAULT ''"
+	SQL_Boolean = "BOOLEAN NOT NULL DEFAULT FALSE"
+)
+
+// Migrations must be kept in ascending order of Version. Steps
+// check for existing tables and columns, so a database created
+// by the old AutoMigrate code is picked up without errors.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: func(tx *gorm.DB) error {
+			for _, model := range []interface{}{&domainV1{}, &addressV1{}, &aliasV1{}} {
+				if tx.HasTable(model) {
+					continue
+				}
+				if err := tx.CreateTable(model).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&aliasV1{}, &addressV1{}, &domainV1{}).Error
+		},
+	},
+	{
+		Version: 2,
+		Name:    "mta-sts policy per domain",
+		Up: func(tx *gorm.DB) error {
+			return MigrateAddColumns(tx, "domains", [][2]string{
+				{"sts_mode",    SQL_String},
+				{"sts_max_age", SQL_Integer},
+				{"sts_mx",      SQL_String},
+			})
+		},
+		Down: func(tx *gorm.DB) error {
+			return MigrateDropColumns(tx, "domains", "sts_mode", "sts_max_age", "sts_mx")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "autoconfig overrides per domain",
+		Up: func(tx *gorm.DB) error {
+			return MigrateAddColumns(tx, "domains", [][2]string{
+				{"imap_host",       SQL_String},
+				{"imap_port",       SQL_Integer},
+				{"imap_security",   SQL_String},
+				{"submit_host",     SQL_String},
+				{"submit_port",     SQL_Integer},
+				{"submit_security", SQL_String},
+			})
+		},
+		Down: func(tx *gorm.DB) error {
+			return MigrateDropColumns(tx, "domains", "imap_host", "imap_port", "imap_security",
+				"submit_host", "submit_port", "submit_security")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "views for postfix and dovecot",
+		Up: func(tx *gorm.DB) error {
+			maildir := MigrateConcat("domain_name", "'/'", "local_part", "'/'")
+			return MigrateCreateViews(tx, [][2]string{
+				{"postfix_virtual_domains",
+					"SELECT name AS domain FROM domains"},
+				{"postfix_virtual_mailboxes",
+					"SELECT email, domain_name AS domain, " + maildir + " AS maildir FROM addresses"},
+				{"postfix_virtual_aliases",
+					"SELECT email AS source, destination FROM aliases"},
+				{"dovecot_users",
+					"SELECT email AS username, domain_name AS domain, sha512 AS password, " + maildir + " AS maildir FROM addresses"},
+			})
+		},
+		Down: func(tx *gorm.DB) error {
+			return MigrateDropViews(tx, "dovecot_users", "postfix_virtual_aliases",
+				"postfix_virtual_mailboxes", "postfix_virtual_domains")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "relay and backup mx domains",
+		Up: func(tx *gorm.DB) error {
+			if err := MigrateAddColumns(tx, "domains", [][2]string{
+				{"domain_type",      "VARCHAR(255) NOT NULL DEFAULT 'mailbox'"},
+				{"transport",        SQL_String},
+				{"relay_recipients", SQL_Text},
+			}); err != nil {
+				return err
+			}
+			if err := tx.CreateTable(&relayRecipientV5{}).Error; err != nil {
+				return err
+			}
+			// Domains without a list of relay recipients accept every recipient
+			return MigrateCreateViews(tx, [][2]string{
+				{"postfix_virtual_domains",
+					"SELECT name AS domain FROM domains WHERE domain_type = 'mailbox'"},
+				{"postfix_relay_domains",
+					"SELECT name AS domain FROM domains WHERE domain_type IN ('relay', 'backup')"},
+				{"postfix_transport_maps",
+					"SELECT name AS domain, transport FROM domains WHERE transport <> ''"},
+				{"postfix_relay_recipients",
+					"SELECT email AS recipient FROM relay_recipients UNION ALL " +
+					"SELECT " + MigrateConcat("'@'", "name") + " AS recipient FROM domains " +
+					"WHERE domain_type IN ('relay', 'backup') AND NOT EXISTS " +
+					"(SELECT 1 FROM relay_recipients WHERE relay_recipients.domain_id = domains.id)"},
+			})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := MigrateCreateViews(tx, [][2]string{
+				{"postfix_virtual_domains",
+					"SELECT name AS domain FROM domains"},
+			}); err != nil {
+				return err
+			}
+			if err := MigrateDropViews(tx, "postfix_relay_recipients", "postfix_transport_maps", "postfix_relay_domains"); err != nil {
+				return err
+			}
+			if err := tx.DropTableIfExists(&relayRecipientV5{}).Error; err != nil {
+				return err
+			}
+			return MigrateDropColumns(tx, "domains", "domain_type", "transport", "relay_recipients")
+		},
+	},
+	{
+		Version: 6,
+		Name:    "outbound rate limits",
+		Up: func(tx *gorm.DB) error {
+			if err := MigrateAddColumns(tx, "addresses", [][2]string{
+				{"msg_limit",  SQL_Integer},
+				{"rcpt_limit", SQL_Integer},
+				{"suspended",  SQL_Boolean},
+			}); err != nil {
+				return err
+			}
+			if err := MigrateAddColumns(tx, "domains", [][2]string{
+				{"msg_limit",  SQL_Integer},
+				{"rcpt_limit", SQL_Integer},
+			}); err != nil {
+				return err
+			}
+			// Suspended accounts can't authenticate any more
+			maildir := MigrateConcat("domain_name", "'/'", "local_part", "'/'")
+			return MigrateCreateViews(tx, [][2]string{
+				{"dovecot_users",
+					"SELECT email AS username, domain_name AS domain, sha512 AS password, " + maildir + " AS maildir FROM addresses WHERE NOT suspended"},
+			})
+		},
+		Down: func(tx *gorm.DB) error {
+			maildir := MigrateConcat("domain_name", "'/'", "local_part", "'/'")
+			if err := MigrateCreateViews(tx, [][2]string{
+				{"dovecot_users",
+					"SELECT email AS username, domain_name AS domain, sha512 AS password, " + maildir + " AS maildir FROM addresses"},
+			}); err != nil {
+				return err
+			}
+			if err := MigrateDropColumns(tx, "domains", "msg_limit", "rcpt_limit"); err != nil {
+				return err
+			}
+			return MigrateDropColumns(tx, "addresses", "msg_limit", "rcpt_limit", "suspended")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "mail log statistics",
+		Up: func(tx *gorm.DB) error {
+			for _, model := range []interface{}{&mailStatV7{}, &mailRejectV7{}, &mailLoginV7{}, &mailLogFileV7{}} {
+				if err := tx.CreateTable(model).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&mailLogFileV7{}, &mailLoginV7{}, &mailRejectV7{}, &mailStatV7{}).Error
+		},
+	},
+	{
+		Version: 8,
+		Name:    "address language",
+		Up: func(tx *gorm.DB) error {
+			return MigrateAddColumns(tx, "addresses", [][2]string{
+				{"language", SQL_String},
+			})
+		},
+		Down: func(tx *gorm.DB) error {
+			return MigrateDropColumns(tx, "addresses", "language")
+		},
+	},
+	{
+		Version: 9,
+		Name:    "outgoing mail queue",
+		Up: func(tx *gorm.DB) error {
+			return tx.CreateTable(&mailQueueV9{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&mailQueueV9{}).Error
+		},
+	},
+	{
+		Version: 10,
+		Name:    "notification templates",
+		Up: func(tx *gorm.DB) error {
+			return tx.CreateTable(&noticeV10{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&noticeV10{}).Error
+		},
+	},
+	{
+		Version: 11,
+		Name:    "failed address hooks",
+		Up: func(tx *gorm.DB) error {
+			return tx.CreateTable(&hookFailureV11{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&hookFailureV11{}).Error
+		},
+	},
+	{
+		Version: 12,
+		Name:    "webhook deliveries",
+		Up: func(tx *gorm.DB) error {
+			return tx.CreateTable(&webhookDeliveryV12{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&webhookDeliveryV12{}).Error
+		},
+	},
+}
+
+func MigrateAddColumns(tx *gorm.DB, table string, columns [][2]string) error {
+	for _, column := range columns {
+		if tx.Dialect().HasColumn(table, column[0]) {
+			continue
+		}
+		sql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s",
+			tx.Dialect().Quote(table), tx.Dialect().Quote(column[0]), column[1])
+		if err := tx.Exec(sql).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func MigrateDropColumns(tx *gorm.DB, table string, columns ...string) error {
+	drop := []string{}
+	for _, column := range columns {
+		if tx.Dialect().HasColumn(table, column) {
+			drop = append(drop, column)
+		}
+	}
+	if len(drop) == 0 {
+		return nil
+	}
+	if DB_Type == "sqlite3" {
+		return MigrateRebuildTable(tx, table, drop)
+	}
+
+	for _, column := range drop {
+		if err := tx.Table(table).DropColumn(column).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateRebuildTable drops columns the way SQLite documents it: copy
+// the rest into a new table, replace the old one and create the indexes
+// again. ALTER TABLE ... DROP COLUMN needs SQLite 3.35 or newer, older
+// go-sqlite3 releases bundle an older one.
+func MigrateRebuildTable(tx *gorm.DB, table string, drop []string) error {
+	dropped := make(map[string]bool)
+	for _, column := range drop {
+		dropped[column] = true
+	}
+
+	var schema struct {
+		SQL           string
+	}
+	if err := tx.Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&schema).Error; err != nil {
+		return err
+	}
+	autoincrement := strings.Contains(strings.ToUpper(schema.SQL), "AUTOINCREMENT")
+
+	rows, err := tx.Raw(fmt.Sprintf("PRAGMA table_info(%s)", tx.Dialect().Quote(table))).Rows()
+	if err != nil {
+		return err
+	}
+	keep := []string{}
+	defs := []string{}
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, kind string
+		var dflt *string
+		if err := rows.Scan(&cid, &name, &kind, &notnull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		if dropped[name] {
+			continue
+		}
+		def := tx.Dialect().Quote(name) + " " + kind
+		if pk > 0 {
+			def += " PRIMARY KEY"
+			if autoincrement {
+				def += " AUTOINCREMENT"
+			}
+		}
+		if notnull > 0 {
+			def += " NOT NULL"
+		}
+		if dflt != nil {
+			def += " DEFAULT " + *dflt
+		}
+		keep = append(keep, tx.Dialect().Quote(name))
+		defs = append(defs, def)
+	}
+	rows.Close()
+
+	indexes := []struct {
+		SQL           string
+	}{}
+	if err := tx.Raw("SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", table).Scan(&indexes).Error; err != nil {
+		return err
+	}
+
+	// Views on table are left alone, they refer to it by name only
+	temp := table + "_rebuild"
+	steps := []string{
+		"PRAGMA legacy_alter_table = ON",
+		fmt.Sprintf("CREATE TABLE %s (%s)", tx.Dialect().Quote(temp), strings.Join(defs, ", ")),
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", tx.Dialect().Quote(temp),
+			strings.Join(keep, ", "), strings.Join(keep, ", "), tx.Dialect().Quote(table)),
+		fmt.Sprintf("DROP TABLE %s", tx.Dialect().Quote(table)),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", tx.Dialect().Quote(temp), tx.Dialect().Quote(table)),
+		"PRAGMA legacy_alter_table = OFF",
+	}
+	for _, index := range indexes {
+		// gorm quotes the column names only sometimes
+		used := false
+		list := index.SQL
+		if open := strings.Index(list, "("); open >= 0 {
+			list = list[open:]
+		}
+		for column, _ := range dropped {
+			if regexp.MustCompile(`\b` + regexp.QuoteMeta(column) + `\b`).MatchString(list) {
+				used = true
+			}
+		}
+		if !used {
+			steps = append(steps, index.SQL)
+		}
+	}
+
+	for _, step := range steps {
+		if err := tx.Exec(step).Error; err != nil {
+			return fmt.Errorf("%s: %s", step, err)
+		}
+	}
+	return nil
+}
+
+// MigrateConcat joins SQL expressions, MySQL doesn't know "||"
+// unless PIPES_AS_CONCAT is set.
+func MigrateConcat(parts ...string) string {
+	if DB_Type == "mysql" {
+		return "CONCAT(" + strings.Join(parts, ", ") + ")"
+	}
+	return "(" + strings.Join(parts, " || ") + ")"
+}
+
+func MigrateCreateViews(tx *gorm.DB, views [][2]string) error {
+	for _, view := range views {
+		if err := MigrateDropViews(tx, view[0]); err != nil {
+			return err
+		}
+		sql := fmt.Sprintf("CREATE VIEW %s AS %s", tx.Dialect().Quote(view[0]), view[1])
+		if err := tx.Exec(sql).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func MigrateDropViews(tx *gorm.DB, views ...string) error {
+	for _, view := range views {
+		sql := fmt.Sprintf("DROP VIEW IF EXISTS %s", tx.Dialect().Quote(view))
+		if err := tx.Exec(sql).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func MigrateLatest() int {
+	return Migrations[len(Migrations) - 1].Version
+}
+
+func MigrateApplied(db *gorm.DB) (map[int]SchemaMigration, error) {
+	applied := make(map[int]SchemaMigration)
+
+	if !db.HasTable(&SchemaMigration{}) {
+		if err := db.CreateTable(&SchemaMigration{}).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	rows := []SchemaMigration{}
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+
+	return applied, nil
+}
+
+// MigrateCurrent returns the highest version applied to db, which
+// may lag behind MigrateLatest until 'migrate up' has been run.
+func MigrateCurrent(db *gorm.DB) (int, error) {
+	applied, err := MigrateApplied(db)
+	if err != nil {
+		return 0, err
+	}
+
+	current := 0
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current, nil
+}
+
+func MigratePending(db *gorm.DB) ([]Migration, error) {
+	applied, err := MigrateApplied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []Migration{}
+	for _, migration := range Migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// MigrateUp applies all pending steps. Note that MySQL commits
+// DDL statements implicitly, so there a failed step may leave
+// parts of its changes behind.
+func MigrateUp(db *gorm.DB) error {
+	pending, err := MigratePending(db)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range pending {
+		log.Printf("INFO  Migrate up %d: %s", migration.Version, migration.Name)
+		tx := db.Begin()
+		if err := migration.Up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", migration.Version, err)
+		}
+		record := SchemaMigration{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			AppliedAt: time.Now(),
+		}
+		if err := tx.Create(&record).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", migration.Version, err)
+		}
+		if err := tx.Commit().Error; err != nil {
+			return fmt.Errorf("migration %d: %s", migration.Version, err)
+		}
+	}
+
+	return nil
+}
+
+func MigrateDown(db *gorm.DB) error {
+	applied, err := MigrateApplied(db)
+	if err != nil {
+		return err
+	}
+
+	for index := len(Migrations) - 1; index >= 0; index-- {
+		migration := Migrations[index]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		log.Printf("INFO  Migrate down %d: %s", migration.Version, migration.Name)
+		tx := db.Begin()
+		if err := migration.Down(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", migration.Version, err)
+		}
+		if err := tx.Where("version = ?", migration.Version).Delete(&SchemaMigration{}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", migration.Version, err)
+		}
+		return tx.Commit().Error
+	}
+
+	log.Printf("INFO  Migrate down: nothing to do")
+	return nil
+}
+
+// MigrateCheck stops the server if the schema is not up to date.
+func MigrateCheck() {
+	db := OpenDB(nil, false)
+	defer CloseDB(db)
+
+	pending, err := MigratePending(db)
+	if err != nil {
+		log.Printf("FATAL MigrateCheck: %s", err)
+		os.Exit(1)
+	}
+	if len(pending) > 0 {
+		log.Printf("FATAL MigrateCheck: %d migration(s) pending, run 'postfix-go migrate up'", len(pending))
+		os.Exit(1)
+	}
+}
+
+func MigrateCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Parse(args)
+
+	db := OpenDB(nil, false)
+	defer CloseDB(db)
+
+	switch flags.Arg(0) {
+	case "status":
+		applied, err := MigrateApplied(db)
+		if err != nil {
+			log.Printf("ERROR Migrate: %s", err)
+			return 1
+		}
+		for _, migration := range Migrations {
+			state := "pending"
+			if row, ok := applied[migration.Version]; ok {
+				state = row.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-40s %s\n", migration.Version, migration.Name, state)
+		}
+		return 0
+	case "up":
+		if err := MigrateUp(db); err != nil {
+			log.Printf("ERROR Migrate: %s", err)
+			return 1
+		}
+		return 0
+	case "down":
+		if err := MigrateDown(db); err != nil {
+			log.Printf("ERROR Migrate: %s", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "usage: postfix-go migrate status|up|down\n")
+	return 2
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"os"
+	"log"
+	"fmt"
+	"time"
+	"bytes"
+	"strings"
+	"path/filepath"
+	"text/template"
+	htmltemplate "html/template"
+	"github.com/jinzhu/gorm"
+	"gopkg.in/gomail.v2"
+)
+
+const (
+	NOTICE_WELCOME   = "welcome"
+	NOTICE_RESET     = "reset"
+	NOTICE_RECOVERY  = "recovery"
+	NOTICE_SUSPENDED = "suspended"
+	NOTICE_QUOTA     = "quota"
+	NOTICE_LETTER    = "letter"	// printed, not mailed
+)
+
+// Default texts live in notices/<lang>/<kind>.txt (with a Subject:
+// line on top) and the optional notices/<lang>/<kind>.html
+const NOTICE_DIR = "notices"
+
+var Notice_Kinds = []string{NOTICE_WELCOME, NOTICE_RESET, NOTICE_RECOVERY, NOTICE_SUSPENDED, NOTICE_QUOTA, NOTICE_LETTER}
+
+// Notice is an edited notification template. DomainID 0 applies
+// to all domains, otherwise it overrides the text for one domain.
+type Notice struct {
+	ID            int         `gorm:"primary_key"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	UpdatedBy     int
+	DomainID      int         `gorm:"unique_index:idx_notice"`
+	Kind          string      `gorm:"unique_index:idx_notice"`
+	Language      string      `gorm:"unique_index:idx_notice"`
+	Subject       string
+	Text          string      `gorm:"type:text"`
+	HTML          string      `gorm:"type:text"`
+	// Computed values
+	DomainName    string      `sql:"-" json:"-"`
+}
+
+// NoticeData is what the templates get to see. Only the fields
+// belonging to the kind of notice are filled in.
+type NoticeData struct {
+	Address       *Address
+	Settings      MailSettings
+	LoginURL      string
+	Initial       string
+	OldEmail      string
+	Messages      int
+	Recipients    int
+	Window        int
+	QuotaUsed     int64
+	QuotaLimit    int64
+	QuotaPercent  int
+}
+
+type NoticePreview struct {
+	Subject       string
+	Text          string
+	HTML          string
+}
+
+func NoticeIsKind(kind string) bool {
+	for _, known := range Notice_Kinds {
+		if kind == known {
+			return true
+		}
+	}
+	return false
+}
+
+// NoticeDefault reads the shipped template, nil if there is none.
+func NoticeDefault(kind, lang string) *Notice {
+	raw, err := os.ReadFile(filepath.Join(NOTICE_DIR, lang, kind + ".txt"))
+	if err != nil {
+		return nil
+	}
+
+	notice := &Notice{Kind: kind, Language: lang}
+	text := strings.Replace(string(raw), "\r\n", "\n", -1)
+	if strings.HasPrefix(text, "Subject:") {
+		line := text
+		if end := strings.Index(text, "\n"); end >= 0 {
+			line, text = text[:end], text[end + 1:]
+		} else {
+			text = ""
+		}
+		notice.Subject = strings.TrimSpace(strings.TrimPrefix(line, "Subject:"))
+	}
+	notice.Text = strings.TrimLeft(text, "\n")
+
+	if raw, err := os.ReadFile(filepath.Join(NOTICE_DIR, lang, kind + ".html")); err == nil {
+		notice.HTML = string(raw)
+	}
+	return notice
+}
+
+// NoticeFind returns the template to use: in the language lang if
+// possible, an override for the domain before one for all domains
+// before the default. The result has ID 0 if it is a default.
+func NoticeFind(kind, lang string, domain_id int, db *gorm.DB) *Notice {
+	langs := []string{lang}
+	if lang != Language {
+		langs = append(langs, Language)
+	}
+
+	for _, lang := range langs {
+		notice := &Notice{}
+		err := db.Where("kind = ? AND language = ? AND domain_id IN (?)", kind, lang, []int{domain_id, 0}).
+			Order("domain_id DESC").First(notice).Error
+		if err == nil {
+			return notice
+		}
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Printf("ERROR NoticeFind: %s", err)
+		}
+		if notice := NoticeDefault(kind, lang); notice != nil {
+			return notice
+		}
+	}
+	return nil
+}
+
+// NoticeDataNew fills in what every notice for address may use.
+func NoticeDataNew(address *Address, db *gorm.DB) *NoticeData {
+	data := &NoticeData{
+		Address:  address,
+		LoginURL: fmt.Sprintf("https://%s%s", Web_Host, LoginURL()),
+		Window:   Policy_Window,
+	}
+	if domain := DomainFindByID(address.DomainID, db); domain != nil {
+		data.Settings = domain.MailSettings(address.Email)
+	}
+	return data
+}
+
+// NoticeSample is the data for the preview, a made up address
+// in domain (or Def_Domain if nil).
+func NoticeSample(domain *Domain, lang string) *NoticeData {
+	if domain == nil {
+		domain = &Domain{Name: Def_Domain}
+	}
+	address := &Address{
+		Email:      "info@" + domain.Name,
+		LocalPart:  "info",
+		DomainName: domain.Name,
+		DomainID:   domain.ID,
+		OtherEmail: "info@example.org",
+		Language:   lang,
+	}
+
+	return &NoticeData{
+		Address:      address,
+		Settings:     domain.MailSettings(address.Email),
+		LoginURL:     fmt.Sprintf("https://%s%s", Web_Host, LoginURL()),
+		Initial:      "Xk3pQ7mZ",
+		OldEmail:     "old@example.org",
+		Messages:     Policy_Messages + 1,
+		Recipients:   Policy_Recipients + 1,
+		Window:       Policy_Window,
+		QuotaUsed:    950,
+		QuotaLimit:   1000,
+		QuotaPercent: 95,
+	}
+}
+
+// NoticeRender executes the subject and text part as plain text and
+// the HTML part with escaping, T translates into lang.
+func NoticeRender(notice *Notice, lang string, data *NoticeData) (*NoticePreview, error) {
+	t := LanguageTfunc(lang)
+	funcs := map[string]interface{}{
+		"T": func(s string, args ...interface{}) string {
+			return t(s, args...)
+		},
+	}
+	preview := &NoticePreview{}
+
+	parts := []struct{
+		name   string
+		source string
+		target *string
+	} {
+		{"subject", notice.Subject, &preview.Subject},
+		{"text",    notice.Text,    &preview.Text},
+	}
+	for _, part := range parts {
+		tmpl, err := template.New(part.name).Funcs(funcs).Parse(part.source)
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.Buffer{}
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		*part.target = buf.String()
+	}
+	preview.Subject = strings.Join(strings.Fields(preview.Subject), " ")
+
+	if strings.TrimSpace(notice.HTML) != "" {
+		tmpl, err := htmltemplate.New("html").Funcs(funcs).Parse(notice.HTML)
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.Buffer{}
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		preview.HTML = buf.String()
+	}
+
+	return preview, nil
+}
+
+// NoticeSend queues the notice kind about address for the
+// recipients to, in the language of address.
+func NoticeSend(kind string, address *Address, to []string, data *NoticeData, db *gorm.DB) error {
+	lang := AddressLanguage(address)
+
+	notice := NoticeFind(kind, lang, address.DomainID, db)
+	if notice == nil {
+		return fmt.Errorf("no template for notice %s", kind)
+	}
+	rendered, err := NoticeRender(notice, notice.Language, data)
+	if err != nil {
+		return fmt.Errorf("notice %s: %s", kind, err)
+	}
+
+	mail := gomail.NewMessage()
+	mail.SetHeader("From",    "postmaster@" + Def_Domain)
+	mail.SetHeader("To",      to...)
+	mail.SetHeader("Subject", rendered.Subject)
+	mail.SetBody("text/plain", rendered.Text)
+	if rendered.HTML != "" {
+		mail.AddAlternative("text/html", rendered.HTML)
+	}
+
+	return MailEnqueue(mail, db)
+}
+
+// NoticeRecipient is where notices for address go, the
+// recovery address if there is one.
+func NoticeRecipient(address *Address) string {
+	if address.OtherEmail != "" {
+		return address.OtherEmail
+	}
+	return address.Email
+}
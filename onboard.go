@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"log"
+	"fmt"
+	"bytes"
+	"errors"
+	"strings"
+	"path/filepath"
+	"text/template"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	ONBOARD_WELCOME  = "welcome"
+	ONBOARD_PASSWORD = "password"
+	ONBOARD_SIEVE    = "sieve"
+)
+
+// Used unless Onboard_Sieve names a script of its own
+const onboardSieve = `require ["fileinto", "mailbox"];
+
+# Created by postfix-go for {{.Email}}
+if header :contains "X-Spam-Flag" "YES" {
+  fileinto :create "Junk";
+  stop;
+}
+`
+
+func OnboardEnabled(action string) bool {
+	for _, enabled := range Onboard_Actions {
+		if enabled == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Onboard runs the Onboard_Actions for a newly created address. A
+// failing action doesn't undo the creation, the errors are collected
+// for the flash message.
+func Onboard(address *Address, uid int, db *gorm.DB) error {
+	errs := []string{}
+	for _, action := range Onboard_Actions {
+		var err error
+		switch action {
+		case ONBOARD_WELCOME:
+			err = OnboardWelcome(address, db)
+		case ONBOARD_PASSWORD:
+			err = OnboardPassword(address, uid, db)
+		case ONBOARD_SIEVE:
+			err = OnboardSieve(address)
+		default:
+			err = fmt.Errorf("unknown action")
+		}
+		if err != nil {
+			log.Printf("ERROR Onboard:%s: %s: %s", action, address.Email, err)
+			errs = append(errs, fmt.Sprintf("%s: %s", action, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// OnboardWelcome greets the new mailbox with the client settings.
+// The recovery address gets its welcome from OnboardPassword
+// if that is enabled, including the interim password.
+func OnboardWelcome(address *Address, db *gorm.DB) error {
+	to := []string{address.Email}
+	if address.OtherEmail != "" && !OnboardEnabled(ONBOARD_PASSWORD) {
+		to = append(to, address.OtherEmail)
+	}
+
+	return NoticeSend(NOTICE_WELCOME, address, to, NoticeDataNew(address, db), db)
+}
+
+// OnboardPassword mails an interim password to the recovery address.
+// Without one the admin prints a letter as before.
+func OnboardPassword(address *Address, uid int, db *gorm.DB) error {
+	if address.OtherEmail == "" {
+		return nil
+	}
+
+	initial, err := AddressInitial(address, uid, db)
+	if err != nil {
+		return err
+	}
+
+	data := NoticeDataNew(address, db)
+	data.Initial = initial
+	return NoticeSend(NOTICE_WELCOME, address, []string{address.OtherEmail}, data, db)
+}
+
+// OnboardSieve prepares the home of the mailbox: the maildir from
+// HookMaildir, the Onboard_Folders, subscribed, and a .dovecot.sieve
+// script. Existing files are left alone.
+func OnboardSieve(address *Address) error {
+	home, err := MaildirPath(address.Email)
+	if err != nil {
+		return err
+	}
+
+	if err := HookMaildir(address.Email); err != nil {
+		return err
+	}
+	for _, folder := range Onboard_Folders {
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(home, "." + folder, sub), 0700); err != nil {
+				return err
+			}
+		}
+	}
+
+	subscriptions := filepath.Join(home, "subscriptions")
+	if _, err := os.Stat(subscriptions); os.IsNotExist(err) {
+		text := strings.Join(Onboard_Folders, "\n") + "\n"
+		if err := os.WriteFile(subscriptions, []byte(text), 0600); err != nil {
+			return err
+		}
+	}
+
+	script := filepath.Join(home, ".dovecot.sieve")
+	if _, err := os.Stat(script); os.IsNotExist(err) {
+		source := onboardSieve
+		if Onboard_Sieve != "" {
+			raw, err := os.ReadFile(Onboard_Sieve)
+			if err != nil {
+				return err
+			}
+			source = string(raw)
+		}
+		tmpl, err := template.New("sieve").Parse(source)
+		if err != nil {
+			return err
+		}
+		buf := bytes.Buffer{}
+		if err := tmpl.Execute(&buf, address); err != nil {
+			return err
+		}
+		if err := os.WriteFile(script, buf.Bytes(), 0600); err != nil {
+			return err
+		}
+	}
+
+	if err := MaildirChown(home); err != nil {
+		return err
+	}
+
+	log.Printf("INFO  Onboard: %s prepared", home)
+	return nil
+}
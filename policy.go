@@ -0,0 +1,235 @@
+package main
+
+import (
+	"os"
+	"io"
+	"log"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"bufio"
+	"strings"
+	"strconv"
+	"github.com/jinzhu/gorm"
+	"gopkg.in/gomail.v2"
+)
+
+type PolicyEvent struct {
+	At            time.Time
+	Recipients    int
+}
+
+var (
+	Policy_Mutex  sync.Mutex
+	Policy_Events = make(map[string][]PolicyEvent)
+)
+
+// PolicyInit starts the Postfix policy delegation server, meant for
+// smtpd_end_of_data_restrictions of the submission service. Counters
+// are kept in memory only, a restart starts a fresh window.
+func PolicyInit() {
+	if Policy_Addr == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", Policy_Addr)
+	if err != nil {
+		log.Printf("FATAL PolicyInit: %s", err)
+		os.Exit(1)
+	}
+	log.Printf("INFO  Policy server listening on %s", Policy_Addr)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("ERROR PolicyInit:Accept: %s", err)
+				continue
+			}
+			go PolicyServe(conn)
+		}
+	}()
+}
+
+// PolicyServe answers requests until Postfix closes the connection.
+// Each request is a list of name=value lines ended by an empty line.
+func PolicyServe(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	attrs := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("ERROR PolicyServe: %s", err)
+			}
+			return
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+				attrs[kv[0]] = kv[1]
+			}
+			continue
+		}
+
+		action := PolicyRequest(attrs)
+		if _, err := fmt.Fprintf(conn, "action=%s\n\n", action); err != nil {
+			log.Printf("ERROR PolicyServe: %s", err)
+			return
+		}
+		attrs = make(map[string]string)
+	}
+}
+
+func PolicyRequest(attrs map[string]string) string {
+	user := strings.ToLower(attrs["sasl_username"])
+	if user == "" {
+		return "DUNNO"
+	}
+
+	db := OpenDB(nil, false)
+	defer CloseDB(db)
+
+	address := AddressFindByEmail(user, db)
+	if address == nil {
+		return "DUNNO"
+	}
+	if address.Suspended {
+		return "REJECT 5.7.1 Account suspended"
+	}
+
+	// Only at the end of the message the recipient count is known
+	if attrs["protocol_state"] != "END-OF-MESSAGE" {
+		return "DUNNO"
+	}
+	recipients, _ := strconv.Atoi(attrs["recipient_count"])
+	if recipients < 1 {
+		recipients = 1
+	}
+
+	msg_limit, rcpt_limit := address.MsgLimit, address.RcptLimit
+	if msg_limit == 0 {
+		msg_limit = Policy_Messages
+	}
+	if rcpt_limit == 0 {
+		rcpt_limit = Policy_Recipients
+	}
+	msgs, rcpts := PolicyCount(fmt.Sprintf("address:%d", address.ID), recipients)
+
+	if Policy_Suspend > 0 && (PolicyOver(msgs, msg_limit * Policy_Suspend) || PolicyOver(rcpts, rcpt_limit * Policy_Suspend)) {
+		PolicySuspend(address, msgs, rcpts, db)
+		return "REJECT 5.7.1 Account suspended"
+	}
+	if PolicyOver(msgs, msg_limit) || PolicyOver(rcpts, rcpt_limit) {
+		log.Printf("INFO  Policy: %s over limit (%d messages, %d recipients)", address.Email, msgs, rcpts)
+		return "DEFER 4.7.1 Rate limit exceeded, try again later"
+	}
+
+	if domain := DomainFindByID(address.DomainID, db); domain != nil {
+		msgs, rcpts := PolicyCount(fmt.Sprintf("domain:%d", domain.ID), recipients)
+		if PolicyOver(msgs, domain.MsgLimit) || PolicyOver(rcpts, domain.RcptLimit) {
+			log.Printf("INFO  Policy: %s over limit (%d messages, %d recipients)", domain.Name, msgs, rcpts)
+			return "DEFER 4.7.1 Domain rate limit exceeded, try again later"
+		}
+	}
+
+	return "DUNNO"
+}
+
+// PolicyOver tells whether count exceeds limit, 0 means no limit.
+func PolicyOver(count, limit int) bool {
+	return limit > 0 && count > limit
+}
+
+// PolicyCount records a message for key and returns the number of
+// messages and recipients within the last Policy_Window minutes.
+func PolicyCount(key string, recipients int) (int, int) {
+	Policy_Mutex.Lock()
+	defer Policy_Mutex.Unlock()
+
+	now := time.Now()
+	since := now.Add(-time.Duration(Policy_Window) * time.Minute)
+
+	events := []PolicyEvent{}
+	for _, event := range Policy_Events[key] {
+		if event.At.After(since) {
+			events = append(events, event)
+		}
+	}
+	events = append(events, PolicyEvent{At: now, Recipients: recipients})
+	Policy_Events[key] = events
+
+	rcpts := 0
+	for _, event := range events {
+		rcpts += event.Recipients
+	}
+	return len(events), rcpts
+}
+
+func PolicyReset(key string) {
+	Policy_Mutex.Lock()
+	defer Policy_Mutex.Unlock()
+
+	delete(Policy_Events, key)
+}
+
+func PolicySuspend(address *Address, msgs, rcpts int, db *gorm.DB) {
+	log.Printf("INFO  Policy: suspending %s (%d messages, %d recipients)", address.Email, msgs, rcpts)
+
+	update := make(map[string]interface{})
+	update["suspended"] = true
+	update["updated_at"] = time.Now()
+	if err := db.Model(address).Updates(update).Error; err != nil {
+		log.Printf("ERROR PolicySuspend:Updates: %s", err)
+		return
+	}
+
+	go PolicyNotify(address.Email, msgs, rcpts)
+}
+
+func PolicyNotify(email string, msgs, rcpts int) {
+	t := LanguageTfunc(Language)
+
+	db := OpenDB(nil, false)
+	defer CloseDB(db)
+
+	admins := []Address{}
+	if err := db.Where("admin = ?", true).Find(&admins).Error; err != nil {
+		log.Printf("ERROR PolicyNotify:Admins: %s", err)
+		return
+	}
+
+	to := []string{}
+	for _, admin := range admins {
+		if admin.OtherEmail != "" {
+			to = append(to, admin.OtherEmail)
+		} else {
+			to = append(to, admin.Email)
+		}
+	}
+
+	mail := gomail.NewMessage()
+	mail.SetHeader("From",    "postmaster@" + Def_Domain)
+	mail.SetHeader("To",      to...)
+	mail.SetHeader("Subject", fmt.Sprintf(t("policy_suspended_subject"), email))
+	mail.SetBody("text/plain", fmt.Sprintf(t("policy_suspended_body"), email, msgs, rcpts, Policy_Window))
+
+	if err := MailEnqueue(mail, db); err != nil {
+		log.Printf("ERROR PolicyNotify:MailEnqueue: %s", err)
+	}
+
+	// The owner is told as well, at the recovery address since
+	// the suspended account may well be in the wrong hands
+	if address := AddressFindByEmail(email, db); address != nil {
+		data := NoticeDataNew(address, db)
+		data.Messages = msgs
+		data.Recipients = rcpts
+		if err := NoticeSend(NOTICE_SUSPENDED, address, []string{NoticeRecipient(address)}, data, db); err != nil {
+			log.Printf("ERROR PolicyNotify:NoticeSend: %s", err)
+		}
+	}
+}
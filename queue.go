@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"time"
+	"reflect"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	QUEUE_PENDING = "pending"
+	QUEUE_SENDING = "sending"
+)
+
+// Queue works off a table whose rows have an ID, a Status and a
+// NextAttempt, like the mail queue and the webhook deliveries. Due
+// rows are claimed by setting them to sending and handed to Work,
+// which records the result.
+type Queue struct {
+	Name          string
+	Model         interface{}
+	Rows          func() interface{}
+	Work          func(job interface{})
+	Expire        func(db *gorm.DB)
+	wake          chan bool
+}
+
+func QueueNew(name string, model interface{}, rows func() interface{}, work func(job interface{})) *Queue {
+	return &Queue{
+		Name:  name,
+		Model: model,
+		Rows:  rows,
+		Work:  work,
+		wake:  make(chan bool, 1),
+	}
+}
+
+// QueueDelay doubles base seconds for each failed attempt, but
+// waits no longer than 12 hours.
+func QueueDelay(base, attempts int) time.Duration {
+	delay := time.Duration(base) * time.Second << uint(attempts)
+	if delay > 12 * time.Hour {
+		delay = 12 * time.Hour
+	}
+	return delay
+}
+
+// Start runs the dispatcher and the workers. Jobs left in sending
+// state by a crash are handed out again.
+func (queue *Queue) Start(workers, interval int) {
+	db := OpenDB(nil, false)
+	if err := db.Model(queue.Model).Where("status = ?", QUEUE_SENDING).UpdateColumn("status", QUEUE_PENDING).Error; err != nil {
+		log.Printf("ERROR Queue:%s: %s", queue.Name, err)
+	}
+	CloseDB(db)
+
+	jobs := make(chan interface{})
+	for worker := 0; worker < workers; worker++ {
+		go queue.Worker(jobs)
+	}
+	go queue.Dispatch(jobs, interval)
+}
+
+func (queue *Queue) Wake() {
+	select {
+	case queue.wake <- true:
+	default:
+	}
+}
+
+// Dispatch hands due jobs to the workers, on every tick of
+// interval seconds and whenever Wake is called.
+func (queue *Queue) Dispatch(jobs chan<- interface{}, interval int) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	for {
+		db := OpenDB(nil, false)
+		if queue.Expire != nil {
+			queue.Expire(db)
+		}
+
+		rows := queue.Rows()
+		if err := db.Where("status = ? AND next_attempt <= ?", QUEUE_PENDING, time.Now()).Order("id").Limit(100).Find(rows).Error; err != nil {
+			log.Printf("ERROR Queue:%s: %s", queue.Name, err)
+		}
+		slice := reflect.ValueOf(rows).Elem()
+		for index := 0; index < slice.Len(); index++ {
+			job := slice.Index(index)
+			// Claim the job, it may have been deleted meanwhile
+			result := db.Model(queue.Model).Where("id = ? AND status = ?", job.FieldByName("ID").Interface(), QUEUE_PENDING).UpdateColumn("status", QUEUE_SENDING)
+			if result.Error != nil {
+				log.Printf("ERROR Queue:%s:Claim: %s", queue.Name, result.Error)
+				continue
+			}
+			if result.RowsAffected == 1 {
+				jobs <- job.Addr().Interface()
+			}
+		}
+		CloseDB(db)
+
+		select {
+		case <-ticker.C:
+		case <-queue.wake:
+		}
+	}
+}
+
+func (queue *Queue) Worker(jobs <-chan interface{}) {
+	for job := range jobs {
+		queue.Work(job)
+	}
+}
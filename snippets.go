@@ -0,0 +1,248 @@
+package main
+
+import (
+	"os"
+	"log"
+	"bytes"
+	"fmt"
+	"flag"
+	"net"
+	"net/url"
+	"strings"
+	"path/filepath"
+	"text/template"
+	"github.com/jinzhu/gorm"
+	"github.com/go-sql-driver/mysql"
+)
+
+type SnippetData struct {
+	MapType       string
+	Driver        string
+	Hosts         string
+	User          string
+	Password      string
+	DBName        string
+	DBPath        string
+	Connect       string
+	Mail_Root     string
+	HomeExpr      string
+	PolicyAddr    string
+}
+
+const snippetsText = `# ---------- /etc/postfix/main.cf (excerpt) ----------
+virtual_mailbox_base    = {{.Mail_Root}}
+virtual_mailbox_domains = {{.MapType}}:/etc/postfix/postfix-go-domains.cf
+virtual_mailbox_maps    = {{.MapType}}:/etc/postfix/postfix-go-mailboxes.cf
+virtual_alias_maps      = {{.MapType}}:/etc/postfix/postfix-go-aliases.cf
+relay_domains           = {{.MapType}}:/etc/postfix/postfix-go-relay-domains.cf
+transport_maps          = {{.MapType}}:/etc/postfix/postfix-go-transport.cf
+relay_recipient_maps    = {{.MapType}}:/etc/postfix/postfix-go-relay-recipients.cf
+{{if .PolicyAddr}}
+# ---------- /etc/postfix/master.cf (submission service) ----------
+  -o smtpd_end_of_data_restrictions=check_policy_service,inet:{{.PolicyAddr}}
+{{end}}{{range $name, $query := .Queries}}
+# ---------- /etc/postfix/postfix-go-{{$name}}.cf ----------
+{{template "connection" $}}query = {{$query}}
+{{end}}
+# ---------- /etc/dovecot/dovecot-sql.conf.ext ----------
+driver = {{.Driver}}
+connect = {{.Connect}}
+default_pass_scheme = SHA512-CRYPT
+password_query = SELECT username AS user, password FROM dovecot_users WHERE username = '%u'
+user_query = SELECT {{.HomeExpr}} AS home FROM dovecot_users WHERE username = '%u'
+# mail_uid and mail_gid must be set in conf.d/10-mail.conf
+`
+
+const snippetsConnection = `{{if .DBPath}}dbpath = {{.DBPath}}
+{{else}}hosts = {{.Hosts}}
+user = {{.User}}
+password = {{.Password}}
+dbname = {{.DBName}}
+{{end}}`
+
+var snippetsTemplates = template.Must(template.Must(template.New("snippets").Parse(snippetsText)).
+	New("connection").Parse(snippetsConnection))
+
+// SnippetConnection translates DB_Connect into the settings of the
+// Postfix lookup tables and the Dovecot SQL driver.
+func SnippetConnection() (SnippetData, error) {
+	data := SnippetData{
+		Mail_Root: Mail_Root,
+		HomeExpr:  MigrateConcat("'" + Mail_Root + "/'", "maildir"),
+		PolicyAddr: Policy_Addr,
+	}
+
+	switch DB_Type {
+	case "sqlite3":
+		path, err := filepath.Abs(strings.SplitN(DB_Connect, "?", 2)[0])
+		if err != nil {
+			return data, err
+		}
+		data.MapType = "sqlite"
+		data.Driver  = "sqlite"
+		data.DBPath  = path
+		data.Connect = path
+	case "mysql":
+		cfg, err := mysql.ParseDSN(DB_Connect)
+		if err != nil {
+			return data, err
+		}
+		data.MapType  = "proxy:mysql"
+		data.Driver   = "mysql"
+		data.User     = cfg.User
+		data.Password = cfg.Passwd
+		data.DBName   = cfg.DBName
+		if cfg.Net == "unix" {
+			data.Hosts   = "unix:" + cfg.Addr
+			data.Connect = fmt.Sprintf("host=%s dbname=%s user=%s password=%s", cfg.Addr, cfg.DBName, cfg.User, cfg.Passwd)
+		} else {
+			host, port, err := net.SplitHostPort(cfg.Addr)
+			if err != nil {
+				host, port = cfg.Addr, "3306"
+			}
+			data.Hosts   = "inet:" + net.JoinHostPort(host, port)
+			data.Connect = fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s", host, port, cfg.DBName, cfg.User, cfg.Passwd)
+		}
+	case "postgres":
+		params := make(map[string]string)
+		if strings.HasPrefix(DB_Connect, "postgres://") || strings.HasPrefix(DB_Connect, "postgresql://") {
+			u, err := url.Parse(DB_Connect)
+			if err != nil {
+				return data, err
+			}
+			params["host"] = u.Hostname()
+			params["port"] = u.Port()
+			params["user"] = u.User.Username()
+			params["password"], _ = u.User.Password()
+			params["dbname"] = strings.TrimPrefix(u.Path, "/")
+		} else {
+			for _, field := range strings.Fields(DB_Connect) {
+				if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+					params[kv[0]] = strings.Trim(kv[1], "'")
+				}
+			}
+		}
+		if params["host"] == "" {
+			params["host"] = "localhost"
+		}
+		if params["port"] == "" {
+			params["port"] = "5432"
+		}
+		data.MapType  = "proxy:pgsql"
+		data.Driver   = "pgsql"
+		data.Hosts    = "inet:" + net.JoinHostPort(params["host"], params["port"])
+		data.User     = params["user"]
+		data.Password = params["password"]
+		data.DBName   = params["dbname"]
+		data.Connect  = fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s",
+			params["host"], params["port"], params["dbname"], params["user"], params["password"])
+	default:
+		return data, fmt.Errorf("unsupported DB_Type %s", DB_Type)
+	}
+
+	return data, nil
+}
+
+// SnippetMaps returns the Postfix lookup tables for relay and backup
+// MX domains in the flat format understood by postmap.
+func SnippetMaps(db *gorm.DB) (map[string]string, error) {
+	domains := []Domain{}
+	if err := db.Order("name").Find(&domains).Error; err != nil {
+		return nil, err
+	}
+
+	relay_domains := bytes.Buffer{}
+	transport := bytes.Buffer{}
+	relay_recipients := bytes.Buffer{}
+	for _, domain := range domains {
+		if domain.Transport != "" {
+			fmt.Fprintf(&transport, "%s\t%s\n", domain.Name, domain.Transport)
+		}
+		if domain.IsMailbox() {
+			continue
+		}
+		fmt.Fprintf(&relay_domains, "%s\tOK\n", domain.Name)
+
+		// Without a list every recipient of the domain is accepted
+		recipients := RelayRecipientList(domain.Name, domain.RelayRecipients)
+		if len(recipients) == 0 {
+			fmt.Fprintf(&relay_recipients, "@%s\tOK\n", domain.Name)
+		}
+		for _, recipient := range recipients {
+			fmt.Fprintf(&relay_recipients, "%s\tOK\n", recipient)
+		}
+	}
+
+	return map[string]string{
+		"relay_domains":    relay_domains.String(),
+		"transport":        transport.String(),
+		"relay_recipients": relay_recipients.String(),
+	}, nil
+}
+
+func ConfigMaps(dir string) int {
+	db := OpenDB(nil, false)
+	defer CloseDB(db)
+
+	maps, err := SnippetMaps(db)
+	if err != nil {
+		log.Printf("ERROR Config:Maps: %s", err)
+		return 1
+	}
+
+	for _, name := range []string{"relay_domains", "transport", "relay_recipients"} {
+		if dir == "" {
+			fmt.Printf("# ---------- %s ----------\n%s\n", name, maps[name])
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(maps[name]), 0644); err != nil {
+			log.Printf("ERROR Config:Maps: %s", err)
+			return 1
+		}
+		log.Printf("INFO  Config: %s written", path)
+	}
+
+	return 0
+}
+
+func ConfigCommand(args []string) int {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.Arg(0) == "maps" {
+		return ConfigMaps(flags.Arg(1))
+	}
+	if flags.Arg(0) != "snippets" {
+		fmt.Fprintf(os.Stderr, "usage: postfix-go config snippets|maps [dir]\n")
+		return 2
+	}
+
+	data, err := SnippetConnection()
+	if err != nil {
+		log.Printf("ERROR Config: %s", err)
+		return 1
+	}
+
+	// The views are created by migrations 4 and 5
+	snippets := struct {
+		SnippetData
+		Queries map[string]string
+	}{
+		SnippetData: data,
+		Queries:     map[string]string{
+			"domains":       "SELECT 1 FROM postfix_virtual_domains WHERE domain = '%s'",
+			"mailboxes":     "SELECT maildir FROM postfix_virtual_mailboxes WHERE email = '%s'",
+			"aliases":       "SELECT destination FROM postfix_virtual_aliases WHERE source = '%s'",
+			"relay-domains": "SELECT 1 FROM postfix_relay_domains WHERE domain = '%s'",
+			"transport":     "SELECT transport FROM postfix_transport_maps WHERE domain = '%s'",
+			"relay-recipients": "SELECT 'OK' FROM postfix_relay_recipients WHERE recipient = '%s'",
+		},
+	}
+	if err := snippetsTemplates.ExecuteTemplate(os.Stdout, "snippets", snippets); err != nil {
+		log.Printf("ERROR Config: %s", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"io"
+	"os"
+	"log"
+	"fmt"
+	"time"
+	"flag"
+	"bytes"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	WEBHOOK_PENDING   = QUEUE_PENDING
+	WEBHOOK_SENDING   = QUEUE_SENDING
+	WEBHOOK_DELIVERED = "delivered"
+	WEBHOOK_FAILED    = "failed"
+)
+
+const (
+	WEBHOOK_DOMAIN_CREATED   = "domain.created"
+	WEBHOOK_DOMAIN_UPDATED   = "domain.updated"
+	WEBHOOK_DOMAIN_RENAMED   = "domain.renamed"
+	WEBHOOK_DOMAIN_DELETED   = "domain.deleted"
+	WEBHOOK_ADDRESS_CREATED  = "address.created"
+	WEBHOOK_ADDRESS_UPDATED  = "address.updated"
+	WEBHOOK_ADDRESS_RENAMED  = "address.renamed"
+	WEBHOOK_ADDRESS_DELETED  = "address.deleted"
+	WEBHOOK_PASSWORD_CHANGED = "password.changed"
+)
+
+// WebhookTarget is one entry of Webhooks in the configuration.
+// Without Events it gets all of them.
+type WebhookTarget struct {
+	URL           string      `mapstructure:"url"`
+	Secret        string      `mapstructure:"secret"`
+	Events        []string    `mapstructure:"events"`
+}
+
+// WebhookDelivery is one event for one target. Delivered and failed
+// ones are kept for Webhook_Keep days as the delivery log.
+type WebhookDelivery struct {
+	ID            int         `gorm:"primary_key"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Event         string
+	URL           string
+	Payload       string      `gorm:"type:text"`
+	Status        string      `gorm:"index"`
+	Attempts      int
+	NextAttempt   time.Time   `gorm:"index"`
+	ResponseCode  int
+	LastError     string      `gorm:"type:text"`
+}
+
+type WebhookDomain struct {
+	ID            int         `json:"id"`
+	Name          string      `json:"name"`
+	OldName       string      `json:"old_name,omitempty"`
+	Type          string      `json:"type"`
+}
+
+type WebhookAddress struct {
+	ID            int         `json:"id"`
+	Email         string      `json:"email"`
+	OldEmail      string      `json:"old_email,omitempty"`
+	Domain        string      `json:"domain"`
+	Admin         bool        `json:"admin"`
+	Suspended     bool        `json:"suspended"`
+}
+
+// WebhookPayload is the JSON body, the HMAC-SHA256 of it with the
+// secret of the target is sent in the X-Webhook-Signature header.
+type WebhookPayload struct {
+	Event         string          `json:"event"`
+	Time          time.Time       `json:"time"`
+	Actor         string          `json:"actor,omitempty"`
+	Domain        *WebhookDomain  `json:"domain,omitempty"`
+	Address       *WebhookAddress `json:"address,omitempty"`
+}
+
+var (
+	Webhook_Queue  = QueueNew("webhook", &WebhookDelivery{}, func() interface{} { return &[]WebhookDelivery{} }, WebhookWork)
+	webhook_client *http.Client
+)
+
+func WebhookDomainOf(domain *Domain, old_name string) *WebhookDomain {
+	return &WebhookDomain{
+		ID:      domain.ID,
+		Name:    domain.Name,
+		OldName: old_name,
+		Type:    domain.DomainType,
+	}
+}
+
+func WebhookAddressOf(address *Address, old_email string) *WebhookAddress {
+	return &WebhookAddress{
+		ID:        address.ID,
+		Email:     address.Email,
+		OldEmail:  old_email,
+		Domain:    address.DomainName,
+		Admin:     address.Admin,
+		Suspended: address.Suspended,
+	}
+}
+
+func WebhookSign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (target *WebhookTarget) Wants(event string) bool {
+	if len(target.Events) == 0 {
+		return true
+	}
+	for _, wanted := range target.Events {
+		if wanted == event || wanted == strings.SplitN(event, ".", 2)[0] + ".*" {
+			return true
+		}
+	}
+	return false
+}
+
+func WebhookTargetFind(url string) *WebhookTarget {
+	for index, _ := range Webhooks {
+		if Webhooks[index].URL == url {
+			return &Webhooks[index]
+		}
+	}
+	return nil
+}
+
+// WebhookInit starts the dispatcher and the workers, like MailInit.
+func WebhookInit() {
+	if len(Webhooks) == 0 {
+		return
+	}
+	for _, target := range Webhooks {
+		log.Printf("INFO  Webhook %s %v", target.URL, target.Events)
+	}
+
+	webhook_client = &http.Client{Timeout: time.Duration(Webhook_Timeout) * time.Second}
+	Webhook_Queue.Expire = WebhookExpire
+	Webhook_Queue.Start(Webhook_Workers, Webhook_Interval)
+}
+
+// WebhookFire queues payload for every target which wants it. It is
+// called after the change was saved, errors are only logged.
+func WebhookFire(payload *WebhookPayload, db *gorm.DB) {
+	if len(Webhooks) == 0 {
+		return
+	}
+	payload.Time = time.Now().UTC()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("ERROR WebhookFire: %s", err)
+		return
+	}
+
+	queued := 0
+	for _, target := range Webhooks {
+		if !target.Wants(payload.Event) {
+			continue
+		}
+		delivery := &WebhookDelivery{
+			Event:       payload.Event,
+			URL:         target.URL,
+			Payload:     string(body),
+			Status:      WEBHOOK_PENDING,
+			NextAttempt: time.Now(),
+		}
+		if err := db.Create(delivery).Error; err != nil {
+			log.Printf("ERROR WebhookFire:Create: %s", err)
+			continue
+		}
+		queued++
+	}
+
+	if queued > 0 {
+		WebhookWake()
+	}
+}
+
+func WebhookWake() {
+	Webhook_Queue.Wake()
+}
+
+// WebhookExpire drops log entries older than Webhook_Keep days.
+func WebhookExpire(db *gorm.DB) {
+	expired := time.Now().AddDate(0, 0, -Webhook_Keep)
+	if err := db.Where("status IN (?) AND updated_at < ?", []string{WEBHOOK_DELIVERED, WEBHOOK_FAILED}, expired).Delete(&WebhookDelivery{}).Error; err != nil {
+		log.Printf("ERROR WebhookExpire: %s", err)
+	}
+}
+
+func WebhookWork(job interface{}) {
+	delivery := job.(*WebhookDelivery)
+	code, err := WebhookSend(webhook_client, delivery)
+
+	db := OpenDB(nil, false)
+	WebhookDone(delivery, code, err, db)
+	CloseDB(db)
+}
+
+func WebhookSend(client *http.Client, delivery *WebhookDelivery) (int, error) {
+	target := WebhookTargetFind(delivery.URL)
+	if target == nil {
+		return 0, fmt.Errorf("%s is no longer configured", delivery.URL)
+	}
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "postfix-go")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", fmt.Sprintf("%d", delivery.ID))
+	if target.Secret != "" {
+		req.Header.Set("X-Webhook-Signature", WebhookSign(target.Secret, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(text)))
+	}
+	return resp.StatusCode, nil
+}
+
+// WebhookDone records the result, doubling the delay for each
+// failed attempt until Webhook_Retries is reached. A target which
+// is no longer configured won't come back, so it fails at once.
+func WebhookDone(delivery *WebhookDelivery, code int, send_err error, db *gorm.DB) {
+	update := make(map[string]interface{})
+	update["attempts"] = delivery.Attempts + 1
+	update["response_code"] = code
+	update["updated_at"] = time.Now()
+
+	if send_err == nil {
+		log.Printf("INFO  Webhook %d %s delivered to %s", delivery.ID, delivery.Event, delivery.URL)
+		update["status"] = WEBHOOK_DELIVERED
+		update["last_error"] = ""
+	} else if delivery.Attempts + 1 >= Webhook_Retries || WebhookTargetFind(delivery.URL) == nil {
+		log.Printf("ERROR Webhook %d %s to %s failed: %s", delivery.ID, delivery.Event, delivery.URL, send_err)
+		update["status"] = WEBHOOK_FAILED
+		update["last_error"] = send_err.Error()
+	} else {
+		delay := QueueDelay(Webhook_Backoff, delivery.Attempts)
+		log.Printf("INFO  Webhook %d %s to %s deferred for %s: %s", delivery.ID, delivery.Event, delivery.URL, delay, send_err)
+		update["status"] = WEBHOOK_PENDING
+		update["next_attempt"] = time.Now().Add(delay)
+		update["last_error"] = send_err.Error()
+	}
+
+	if err := db.Model(delivery).Updates(update).Error; err != nil {
+		log.Printf("ERROR WebhookDone:Updates: %s", err)
+	}
+}
+
+// WebhookListen is a receiver for testing: it prints every
+// request and checks the signature if a secret is given.
+func WebhookListen(addr, secret string, fail bool) int {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		check := "unsigned"
+		if secret != "" {
+			check = "BAD SIGNATURE"
+			if hmac.Equal([]byte(r.Header.Get("X-Webhook-Signature")), []byte(WebhookSign(secret, body))) {
+				check = "signature ok"
+			}
+		}
+		fmt.Printf("%s %s #%s %s (%s)\n%s\n", time.Now().Format(time.RFC3339), r.URL.Path,
+			r.Header.Get("X-Webhook-Delivery"), r.Header.Get("X-Webhook-Event"), check, body)
+
+		if fail || check == "BAD SIGNATURE" {
+			http.Error(w, check, http.StatusInternalServerError)
+		}
+	})
+
+	log.Printf("INFO  Webhook receiver on %s", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Printf("ERROR Webhook: %s", err)
+		return 1
+	}
+	return 0
+}
+
+func WebhookCommand(args []string) int {
+	if len(args) == 0 || args[0] != "listen" {
+		fmt.Fprintf(os.Stderr, "usage: postfix-go webhook listen [-addr :9000] [-secret s] [-fail]\n")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("webhook listen", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:9000", "address to listen on")
+	secret := flags.String("secret", "", "secret to check the signatures with")
+	fail := flags.Bool("fail", false, "answer every request with an error")
+	flags.Parse(args[1:])
+
+	return WebhookListen(*addr, *secret, *fail)
+}